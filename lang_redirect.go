@@ -1,146 +1,2915 @@
 package traefik_lang_redirect
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/language"
 )
 
-const StrategyHeader = "header"
-const StrategyPath = "path"
-const StrategyQuery = "query"
+const StrategyHeader = "header"
+const StrategyPath = "path"
+const StrategyQuery = "query"
+const StrategyCookie = "cookie"
+
+const PathPositionPrefix = "prefix"
+const PathPositionSuffix = "suffix"
+
+const TrailingSlashNone = "none"
+const TrailingSlashAdd = "add"
+const TrailingSlashRemove = "remove"
+
+const QueryPersistenceKeep = "keep"
+const QueryPersistenceStripAfterCookie = "strip-after-cookie"
+
+const BackendFormatRaw = "raw"
+const BackendFormatISO6391 = "iso639-1"
+
+const ReconcileNone = ""
+const ReconcilePathWins = "path-wins"
+const ReconcileQueryWins = "query-wins"
+const ReconcileRedirect = "redirect-to-consistent"
+
+const RedirectCountHeader = "X-Lang-Redirect-Count"
+const ClientHintLanguageHeader = "Sec-CH-Lang"
+const HandledHeader = "X-Language-Handled"
+
+const MatcherBuiltin = "builtin"
+const MatcherStrict = "strict"
+const LogFormatText = "text"
+const LogFormatJSON = "json"
+
+// Sources of a detected language, besides the strategy names for a language already in the request.
+const SourceHeader = "header"
+const SourceCookie = "cookie"
+const SourceOverride = "override"
+const SourceForced = "forced"
+const SourceReferer = "referer"
+const SourceGeo = "geo"
+const SourceCountryFallback = "country-fallback"
+const SourceForm = "form"
+const SourceStore = "store"
+const SourceFallback = "fallback"
+const SourceDefault = "default"
+const SourceDefaultMatch = "default-match"
+const SourceDefaultFallback = "default-fallback"
+
+// Config the plugin configuration.
+type Config struct {
+	Languages                       []string            `yaml:"languages"`
+	DefaultLanguage                 string              `yaml:"defaultLanguage"`
+	DefaultLanguageHandling         bool                `yaml:"defaultLanguageHandling"`
+	LanguageStrategy                string              `yaml:"languageStrategy"`
+	LanguageParam                   string              `yaml:"languageParam"`
+	RedirectAfterHandling           bool                `yaml:"redirectAfterHandling"`
+	OnlyDocumentRequests            bool                `yaml:"onlyDocumentRequests"`
+	BaseLanguageDefaults            map[string]string   `yaml:"baseLanguageDefaults"`
+	MaxLanguageEntries              int                 `yaml:"maxLanguageEntries"`
+	PropagateHeader                 string              `yaml:"propagateHeader"`
+	PathPosition                    string              `yaml:"pathPosition"`
+	SkipAuthenticated               bool                `yaml:"skipAuthenticated"`
+	SessionCookieName               string              `yaml:"sessionCookieName"`
+	ErrorBody                       string              `yaml:"errorBody"`
+	QueryValueAliases               map[string]string   `yaml:"queryValueAliases"`
+	ExplicitOverridesHeader         bool                `yaml:"explicitOverridesHeader"`
+	NormalizeTrailingSlash          string              `yaml:"normalizeTrailingSlash"`
+	FirstVisitOnly                  bool                `yaml:"firstVisitOnly"`
+	FirstVisitCookieName            string              `yaml:"firstVisitCookieName"`
+	MatcherMode                     string              `yaml:"matcherMode"`
+	SkipRangeRequests               bool                `yaml:"skipRangeRequests"`
+	CollapseToBase                  []string            `yaml:"collapseToBase"`
+	NegotiationProbePath            string              `yaml:"negotiationProbePath"`
+	FallbackLanguages               []string            `yaml:"fallbackLanguages"`
+	CanonicalizeURL                 bool                `yaml:"canonicalizeURL"`
+	PreferenceKeyHeader             string              `yaml:"preferenceKeyHeader"`
+	CookieName                      string              `yaml:"cookieName"`
+	QueryPersistence                string              `yaml:"queryPersistence"`
+	BackendLanguageFormat           string              `yaml:"backendLanguageFormat"`
+	AbsoluteRedirect                bool                `yaml:"absoluteRedirect"`
+	MaxRedirects                    int                 `yaml:"maxRedirects"`
+	PathQueryReconcile              string              `yaml:"pathQueryReconcile"`
+	RememberPathLanguage            bool                `yaml:"rememberPathLanguage"`
+	LanguageAliases                 map[string]string   `yaml:"languageAliases"`
+	ExcludedExtensions              []string            `yaml:"excludedExtensions"`
+	LogFormat                       string              `yaml:"logFormat"`
+	LogRedirects                    bool                `yaml:"logRedirects"`
+	CurrentLanguageHeader           string              `yaml:"currentLanguageHeader"`
+	PathLanguageMap                 map[string]string   `yaml:"pathLanguageMap"`
+	RespectDNT                      bool                `yaml:"respectDNT"`
+	DetectOnlyPaths                 []string            `yaml:"detectOnlyPaths"`
+	NormalizeUnderscores            bool                `yaml:"normalizeUnderscores"`
+	RedirectStatusCode              int                 `yaml:"redirectStatusCode"`
+	CanonicalStatusCode             int                 `yaml:"canonicalStatusCode"`
+	PreserveQueryParams             []string            `yaml:"preserveQueryParams"`
+	OverrideSecret                  string              `yaml:"overrideSecret"`
+	OverrideCookieName              string              `yaml:"overrideCookieName"`
+	PreferConfigOrder               bool                `yaml:"preferConfigOrder"`
+	ForceLanguage                   string              `yaml:"forceLanguage"`
+	UseRefererLanguage              bool                `yaml:"useRefererLanguage"`
+	StripDefaultQueryParam          bool                `yaml:"stripDefaultQueryParam"`
+	ExplicitPathOverridesCookie     bool                `yaml:"explicitPathOverridesCookie"`
+	UseClientHints                  bool                `yaml:"useClientHints"`
+	EmitAlternateLinks              bool                `yaml:"emitAlternateLinks"`
+	EnforcedLanguages               []string            `yaml:"enforcedLanguages"`
+	CountryHeader                   string              `yaml:"countryHeader"`
+	CountryLanguageMap              map[string]string   `yaml:"countryLanguageMap"`
+	RejectUnsupportedPathLanguage   bool                `yaml:"rejectUnsupportedPathLanguage"`
+	RejectStatusCode                int                 `yaml:"rejectStatusCode"`
+	RejectPathLanguages             []string            `yaml:"rejectPathLanguages"`
+	SourceHeader                    string              `yaml:"sourceHeader"`
+	CookieOnly                      bool                `yaml:"cookieOnly"`
+	AcceptLanguageHeaders           []string            `yaml:"acceptLanguageHeaders"`
+	ReadFormLanguage                bool                `yaml:"readFormLanguage"`
+	FormLanguageField               string              `yaml:"formLanguageField"`
+	GeoCacheTTL                     string              `yaml:"geoCacheTTL"`
+	GeoCacheSize                    int                 `yaml:"geoCacheSize"`
+	AlsoPropagateHeader             string              `yaml:"alsoPropagateHeader"`
+	InfoAllowOrigin                 string              `yaml:"infoAllowOrigin"`
+	CookieJSONField                 string              `yaml:"cookieJSONField"`
+	SkipPrefetch                    bool                `yaml:"skipPrefetch"`
+	ExpandBaseTo                    map[string]string   `yaml:"expandBaseTo"`
+	TrustedProxies                  []string            `yaml:"trustedProxies"`
+	CollapseSlashes                 bool                `yaml:"collapseSlashes"`
+	DistinguishDefaultSource        bool                `yaml:"distinguishDefaultSource"`
+	CookieMergeJSON                 bool                `yaml:"cookieMergeJSON"`
+	QueryValueDelimiter             string              `yaml:"queryValueDelimiter"`
+	NotFoundRedirectPath            string              `yaml:"notFoundRedirectPath"`
+	NoRedirectParam                 string              `yaml:"noRedirectParam"`
+	UseFirstLanguageAsDefault       bool                `yaml:"useFirstLanguageAsDefault"`
+	PreferExactRegion               bool                `yaml:"preferExactRegion"`
+	LanguageTrailer                 string              `yaml:"languageTrailer"`
+	SessionScoped                   bool                `yaml:"sessionScoped"`
+	SessionMarkerCookieName         string              `yaml:"sessionMarkerCookieName"`
+	BackendHostTemplate             string              `yaml:"backendHostTemplate"`
+	OverwriteUpstreamAcceptLanguage bool                `yaml:"overwriteUpstreamAcceptLanguage"`
+	CookieOnSuccessOnly             bool                `yaml:"cookieOnSuccessOnly"`
+	CountryFallbacks                map[string][]string `yaml:"countryFallbacks"`
+	ReadStrategy                    string              `yaml:"readStrategy"`
+	WriteStrategy                   string              `yaml:"writeStrategy"`
+	RedirectBody                    bool                `yaml:"redirectBody"`
+	RedirectBodyTemplate            string              `yaml:"redirectBodyTemplate"`
+	CookiePrecedence                bool                `yaml:"cookiePrecedence"`
+	IgnoreLanguages                 []string            `yaml:"ignoreLanguages"`
+	RedirectMarkerParam             string              `yaml:"redirectMarkerParam"`
+	SkipIfHandled                   bool                `yaml:"skipIfHandled"`
+	IncludePathRegex                string              `yaml:"includePathRegex"`
+	ExcludePathRegex                string              `yaml:"excludePathRegex"`
+	RegionGroups                    map[string]string   `yaml:"regionGroups"`
+	ShowPickerOnNoMatch             bool                `yaml:"showPickerOnNoMatch"`
+	PickerTemplate                  string              `yaml:"pickerTemplate"`
+}
+
+// CreateConfig creates the default plugin configuration.
+func CreateConfig() *Config {
+	return &Config{
+		Languages:               []string{},
+		DefaultLanguage:         "",
+		DefaultLanguageHandling: false,
+		LanguageStrategy:        "header",
+		LanguageParam:           "lang",
+		RedirectAfterHandling:   false,
+		OnlyDocumentRequests:    false,
+		BaseLanguageDefaults:    map[string]string{},
+		MaxLanguageEntries:      32,
+		PropagateHeader:         "",
+		PathPosition:            PathPositionPrefix,
+		SkipAuthenticated:       false,
+		SessionCookieName:       "",
+		ErrorBody:               "Internal Server Error",
+		QueryValueAliases:       map[string]string{},
+		ExplicitOverridesHeader: false,
+		NormalizeTrailingSlash:  TrailingSlashNone,
+		FirstVisitOnly:          false,
+		FirstVisitCookieName:    "lang_redirect_seen",
+		MatcherMode:             MatcherBuiltin,
+		SkipRangeRequests:       true,
+		CollapseToBase:          []string{},
+		NegotiationProbePath:    "",
+		FallbackLanguages:       []string{},
+		CanonicalizeURL:         false,
+		PreferenceKeyHeader:     "",
+		CookieName:              "lang",
+		QueryPersistence:        QueryPersistenceKeep,
+		BackendLanguageFormat:   BackendFormatRaw,
+		AbsoluteRedirect:        false,
+		MaxRedirects:            3,
+		PathQueryReconcile:      ReconcileNone,
+		RememberPathLanguage:    false,
+		LanguageAliases:         map[string]string{},
+		ExcludedExtensions: []string{
+			".js", ".mjs", ".css", ".map", ".json", ".xml", ".txt",
+			".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico",
+			".woff", ".woff2", ".ttf", ".otf", ".eot",
+			".mp4", ".webm", ".mp3", ".pdf", ".zip", ".wasm",
+		},
+		LogFormat:                       LogFormatText,
+		LogRedirects:                    false,
+		CurrentLanguageHeader:           "",
+		PathLanguageMap:                 map[string]string{},
+		RespectDNT:                      false,
+		DetectOnlyPaths:                 []string{},
+		NormalizeUnderscores:            true,
+		RedirectStatusCode:              http.StatusFound,
+		CanonicalStatusCode:             http.StatusFound,
+		PreserveQueryParams:             []string{},
+		OverrideSecret:                  "",
+		OverrideCookieName:              "lang_override",
+		PreferConfigOrder:               false,
+		ForceLanguage:                   "",
+		UseRefererLanguage:              false,
+		StripDefaultQueryParam:          false,
+		ExplicitPathOverridesCookie:     false,
+		UseClientHints:                  false,
+		EmitAlternateLinks:              false,
+		EnforcedLanguages:               []string{},
+		CountryHeader:                   "",
+		CountryLanguageMap:              map[string]string{},
+		RejectUnsupportedPathLanguage:   false,
+		RejectStatusCode:                http.StatusNotFound,
+		RejectPathLanguages:             []string{},
+		SourceHeader:                    "",
+		CookieOnly:                      false,
+		AcceptLanguageHeaders:           []string{"Accept-Language"},
+		ReadFormLanguage:                false,
+		FormLanguageField:               "language",
+		GeoCacheTTL:                     "",
+		GeoCacheSize:                    1024,
+		AlsoPropagateHeader:             "",
+		InfoAllowOrigin:                 "",
+		CookieJSONField:                 "",
+		SkipPrefetch:                    true,
+		ExpandBaseTo:                    map[string]string{},
+		TrustedProxies:                  []string{},
+		CollapseSlashes:                 false,
+		DistinguishDefaultSource:        false,
+		CookieMergeJSON:                 false,
+		QueryValueDelimiter:             "",
+		NotFoundRedirectPath:            "",
+		NoRedirectParam:                 "",
+		UseFirstLanguageAsDefault:       false,
+		PreferExactRegion:               false,
+		LanguageTrailer:                 "",
+		SessionScoped:                   false,
+		SessionMarkerCookieName:         "lang_session",
+		BackendHostTemplate:             "",
+		OverwriteUpstreamAcceptLanguage: false,
+		CookieOnSuccessOnly:             false,
+		CountryFallbacks:                map[string][]string{},
+		ReadStrategy:                    "",
+		WriteStrategy:                   "",
+		RedirectBody:                    false,
+		RedirectBodyTemplate:            defaultRedirectBodyTemplate,
+		CookiePrecedence:                false,
+		IgnoreLanguages:                 []string{},
+		RedirectMarkerParam:             "",
+		SkipIfHandled:                   false,
+		IncludePathRegex:                "",
+		ExcludePathRegex:                "",
+		RegionGroups:                    map[string]string{},
+		ShowPickerOnNoMatch:             false,
+		PickerTemplate:                  defaultPickerTemplate,
+	}
+}
+
+// LangRedirect a plugin.
+type LangRedirect struct {
+	next    http.Handler
+	config  *Config
+	name    string
+	logger  *log.Logger
+	matcher language.Matcher
+	store   PreferenceStore
+	// resolver of the client country, with an optional cache of its results
+	resolver CountryResolver
+	geoCache *geoCache
+	// languages the plugin may find in or write to a request, Config.Languages plus collapsed bases
+	languages []string
+	// Config.LanguageAliases keyed by the normalized tag
+	aliases map[string]string
+	// Config.Languages keyed by the normalized tag, for header matching
+	lookup map[string]string
+	// index of each Config.Languages entry, for config order tie-breaks
+	rank map[string]int
+	// server-side weights of Config.Languages ("en;w=2"), for tie-breaks and wildcards
+	weights map[string]float64
+	// Config.CountryLanguageMap and Config.CountryFallbacks keyed by the uppercase country code
+	countries        map[string]string
+	countryFallbacks map[string][]string
+	// Config.ExpandBaseTo keyed by the lowercase base language
+	expansions map[string]string
+	// Config.RegionGroups keyed by each uppercase region of a group
+	regionGroups map[string]string
+	// Config.TrustedProxies ranges, forwarded headers are trusted from any address when empty
+	proxies []*net.IPNet
+	// Config.IncludePathRegex and Config.ExcludePathRegex, nil when unset
+	includePath *regexp.Regexp
+	excludePath *regexp.Regexp
+}
+
+// CountryResolver resolves the country code of a client IP, e.g. with a GeoIP database.
+type CountryResolver interface {
+	Country(ip string) (string, bool)
+}
+
+// PreferenceStore persists the language of identified users on the server side.
+type PreferenceStore interface {
+	Get(key string) (string, bool)
+	Set(key, lang string)
+}
+
+// Option customizes a plugin created with NewWithOptions.
+type Option func(*LangRedirect)
+
+// WithLogger writes the plugin logs to the given logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(g *LangRedirect) {
+		g.logger = logger
+	}
+}
+
+// WithPreferenceStore consults the store for the language of requests identified by Config.PreferenceKeyHeader.
+func WithPreferenceStore(store PreferenceStore) Option {
+	return func(g *LangRedirect) {
+		g.store = store
+	}
+}
+
+// WithCountryResolver resolves the client country from its IP when the country header is missing.
+func WithCountryResolver(resolver CountryResolver) Option {
+	return func(g *LangRedirect) {
+		g.resolver = resolver
+	}
+}
+
+// New creates a new plugin.
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	return NewWithOptions(ctx, next, config, name)
+}
+
+// NewWithLogger creates a new plugin writing its logs to the given logger, for use as a library.
+func NewWithLogger(ctx context.Context, next http.Handler, config *Config, name string, logger *log.Logger) (http.Handler, error) {
+	return NewWithOptions(ctx, next, config, name, WithLogger(logger))
+}
+
+// NewWithOptions creates a new plugin customized by options that cannot be expressed in the Traefik configuration.
+func NewWithOptions(ctx context.Context, next http.Handler, config *Config, name string, options ...Option) (http.Handler, error) {
+	// The derived values below never leak into the configuration of the caller, which may build further middlewares
+	copied := *config
+	config = &copied
+
+	plugin := &LangRedirect{
+		next:   next,
+		config: config,
+		name:   name,
+		logger: log.Default(),
+	}
+	for _, option := range options {
+		option(plugin)
+	}
+	// One JSON object per line, the timestamp is a field
+	if config.LogFormat == LogFormatJSON {
+		plugin.logger = log.New(plugin.logger.Writer(), "", 0)
+	}
+
+	languages, weights, weightErr := parseLanguageWeights(config.Languages)
+	config.Languages, plugin.weights = languages, weights
+	plugin.deriveConfig()
+
+	if err := joinErrors(weightErr, validateConfig(config)); err != nil {
+		return nil, err
+	}
+
+	plugin.indexLanguages()
+	plugin.indexCountries()
+	plugin.compileRequestFilters()
+
+	return plugin, nil
+}
+
+// deriveConfig fills in the configuration values implied by other options, before it is validated.
+func (g *LangRedirect) deriveConfig() {
+	config := g.config
+
+	// The decision is applied with the write strategy, the read strategy only provides the current language
+	if config.WriteStrategy != "" {
+		config.LanguageStrategy = config.WriteStrategy
+	}
+
+	// Only the cookie is ever written, the URL stays as requested
+	if config.CookieOnly {
+		config.LanguageStrategy = StrategyCookie
+		config.RedirectAfterHandling = false
+	}
+
+	if languages, ok := uniqueLanguages(config.Languages); !ok {
+		g.logEvent(logEntry{Action: "config", Message: fmt.Sprintf("duplicate entries removed from languages: %v", languages)})
+		config.Languages = languages
+	}
+
+	// Minimal configurations default to the first language
+	if config.UseFirstLanguageAsDefault && config.DefaultLanguage == "" && len(config.Languages) > 0 {
+		config.DefaultLanguage = config.Languages[0]
+	}
+}
+
+// indexLanguages builds the lookups of the configured languages and of the options mapping to them.
+func (g *LangRedirect) indexLanguages() {
+	config := g.config
+
+	g.languages = append(append([]string{}, config.Languages...), config.CollapseToBase...)
+
+	g.lookup = make(map[string]string, len(config.Languages))
+	g.rank = make(map[string]int, len(config.Languages))
+	for i, lang := range config.Languages {
+		g.lookup[normalizeTag(lang)] = lang
+		g.rank[lang] = i
+	}
+
+	g.aliases = make(map[string]string, len(config.LanguageAliases))
+	for alias, lang := range config.LanguageAliases {
+		g.aliases[normalizeTag(alias)] = lang
+	}
+
+	g.expansions = make(map[string]string, len(config.ExpandBaseTo))
+	for base, lang := range config.ExpandBaseTo {
+		g.expansions[asciiLower(base)] = lang
+	}
+
+	g.regionGroups = make(map[string]string, len(config.RegionGroups))
+	for group, lang := range config.RegionGroups {
+		for _, region := range strings.Split(group, ",") {
+			g.regionGroups[asciiUpper(strings.TrimSpace(region))] = lang
+		}
+	}
+
+	if config.MatcherMode == MatcherStrict {
+		g.matcher = newStrictMatcher(config.Languages)
+	}
+}
+
+// indexCountries builds the lookups of the country options and the cache of the resolved countries.
+func (g *LangRedirect) indexCountries() {
+	config := g.config
+
+	if ttl, _ := time.ParseDuration(config.GeoCacheTTL); ttl > 0 && g.resolver != nil {
+		g.geoCache = newGeoCache(ttl, config.GeoCacheSize)
+	}
+
+	g.countries = make(map[string]string, len(config.CountryLanguageMap))
+	for country, lang := range config.CountryLanguageMap {
+		g.countries[asciiUpper(country)] = lang
+	}
+	g.countryFallbacks = make(map[string][]string, len(config.CountryFallbacks))
+	for country, fallbacks := range config.CountryFallbacks {
+		g.countryFallbacks[asciiUpper(country)] = fallbacks
+	}
+}
+
+// compileRequestFilters parses the trusted proxies and the path patterns the requests are checked against.
+func (g *LangRedirect) compileRequestFilters() {
+	config := g.config
+
+	for _, proxy := range config.TrustedProxies {
+		if network, err := parseTrustedProxy(proxy); err == nil {
+			g.proxies = append(g.proxies, network)
+		}
+	}
+	if len(g.proxies) == 0 && (config.AbsoluteRedirect || config.EmitAlternateLinks) {
+		g.logEvent(logEntry{Action: "config", Message: "X-Forwarded-Host and X-Forwarded-Proto are trusted from any " +
+			"client for absolute URLs, set trustedProxies to the addresses of the proxies in front"})
+	}
+
+	if config.IncludePathRegex != "" {
+		g.includePath = regexp.MustCompile(config.IncludePathRegex)
+	}
+	if config.ExcludePathRegex != "" {
+		g.excludePath = regexp.MustCompile(config.ExcludePathRegex)
+	}
+}
+
+// joinErrors combines the non-nil errors into one, a message per line, nil when there are none.
+func joinErrors(errs ...error) error {
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// validateConfig reports all configuration problems at once.
+func validateConfig(config *Config) error {
+	var errs []error
+
+	if len(config.Languages) == 0 {
+		errs = append(errs, fmt.Errorf("languages are required"))
+	}
+
+	if config.DefaultLanguage == "" {
+		errs = append(errs, fmt.Errorf("DefaultLanguage is required"))
+	}
+
+	errs = append(errs, validateStrategies(config)...)
+	errs = append(errs, validateFormOptions(config)...)
+	errs = append(errs, validateURLOptions(config)...)
+	errs = append(errs, validateDetectionOptions(config)...)
+	errs = append(errs, validateRedirectOptions(config)...)
+	errs = append(errs, validateCookieOptions(config)...)
+	errs = append(errs, validatePickerOptions(config)...)
+	errs = append(errs, validateProxyOptions(config)...)
+	errs = append(errs, validateLoggingOptions(config)...)
+	errs = append(errs, validateMappedLanguages(config)...)
+
+	return joinErrors(errs...)
+}
+
+// validateStrategies checks the strategies and the options they depend on.
+func validateStrategies(config *Config) []error {
+	var errs []error
+
+	if !isStrategy(config.LanguageStrategy) {
+		errs = append(errs, fmt.Errorf("invalid LanguageStrategy: %s", config.LanguageStrategy))
+	}
+	if (config.ReadStrategy == "") != (config.WriteStrategy == "") {
+		errs = append(errs, fmt.Errorf("readStrategy and writeStrategy must be set together"))
+	}
+	if config.ReadStrategy != "" && !isStrategy(config.ReadStrategy) {
+		errs = append(errs, fmt.Errorf("invalid ReadStrategy: %s", config.ReadStrategy))
+	}
+	if config.WriteStrategy != "" && !isStrategy(config.WriteStrategy) {
+		errs = append(errs, fmt.Errorf("invalid WriteStrategy: %s", config.WriteStrategy))
+	}
+
+	if config.LanguageStrategy == StrategyQuery && config.LanguageParam == "" {
+		errs = append(errs, fmt.Errorf("languageParam is required when LanguageStrategy is 'query'"))
+	}
+
+	return errs
+}
+
+// validateFormOptions checks the language read from submitted forms.
+func validateFormOptions(config *Config) []error {
+	if !config.ReadFormLanguage {
+		return nil
+	}
+
+	var errs []error
+	if config.LanguageStrategy != StrategyQuery && config.LanguageStrategy != StrategyCookie {
+		errs = append(errs, fmt.Errorf("readFormLanguage requires the 'query' or 'cookie' LanguageStrategy"))
+	}
+	if config.FormLanguageField == "" {
+		errs = append(errs, fmt.Errorf("formLanguageField is required when ReadFormLanguage is enabled"))
+	}
+	return errs
+}
+
+// validateURLOptions checks how the language is written to and read from the URL.
+func validateURLOptions(config *Config) []error {
+	var errs []error
+
+	if config.QueryPersistence != QueryPersistenceKeep && config.QueryPersistence != QueryPersistenceStripAfterCookie {
+		errs = append(errs, fmt.Errorf("invalid QueryPersistence: %s", config.QueryPersistence))
+	}
+
+	switch config.PathQueryReconcile {
+	case ReconcileNone, ReconcilePathWins, ReconcileQueryWins, ReconcileRedirect:
+	default:
+		errs = append(errs, fmt.Errorf("invalid PathQueryReconcile: %s", config.PathQueryReconcile))
+	}
+
+	if config.PathPosition != PathPositionPrefix && config.PathPosition != PathPositionSuffix {
+		errs = append(errs, fmt.Errorf("invalid PathPosition: %s", config.PathPosition))
+	}
+
+	switch config.NormalizeTrailingSlash {
+	case TrailingSlashNone, TrailingSlashAdd, TrailingSlashRemove:
+	default:
+		errs = append(errs, fmt.Errorf("invalid NormalizeTrailingSlash: %s", config.NormalizeTrailingSlash))
+	}
+
+	if _, err := regexp.Compile(config.IncludePathRegex); err != nil {
+		errs = append(errs, fmt.Errorf("invalid IncludePathRegex: %w", err))
+	}
+	if _, err := regexp.Compile(config.ExcludePathRegex); err != nil {
+		errs = append(errs, fmt.Errorf("invalid ExcludePathRegex: %w", err))
+	}
+
+	return errs
+}
+
+// validateDetectionOptions checks how the language is detected and passed to the backend.
+func validateDetectionOptions(config *Config) []error {
+	var errs []error
+
+	if config.MatcherMode != MatcherBuiltin && config.MatcherMode != MatcherStrict {
+		errs = append(errs, fmt.Errorf("invalid MatcherMode: %s", config.MatcherMode))
+	}
+
+	if config.MaxLanguageEntries <= 0 {
+		errs = append(errs, fmt.Errorf("maxLanguageEntries must be positive"))
+	}
+
+	if config.ForceLanguage != "" && !containsLanguage(config.Languages, config.ForceLanguage) {
+		errs = append(errs, fmt.Errorf("forceLanguage: unsupported language %s", config.ForceLanguage))
+	}
+
+	if config.BackendLanguageFormat != BackendFormatRaw && config.BackendLanguageFormat != BackendFormatISO6391 {
+		errs = append(errs, fmt.Errorf("invalid BackendLanguageFormat: %s", config.BackendLanguageFormat))
+	}
+
+	if config.GeoCacheTTL != "" {
+		if ttl, err := time.ParseDuration(config.GeoCacheTTL); err != nil || ttl < 0 {
+			errs = append(errs, fmt.Errorf("invalid GeoCacheTTL: %s", config.GeoCacheTTL))
+		}
+		if config.GeoCacheSize <= 0 {
+			errs = append(errs, fmt.Errorf("geoCacheSize must be positive"))
+		}
+	}
+
+	return errs
+}
+
+// validateRedirectOptions checks the responses answering with a redirect or instead of one.
+func validateRedirectOptions(config *Config) []error {
+	var errs []error
+
+	if !isRedirectStatus(config.RedirectStatusCode) {
+		errs = append(errs, fmt.Errorf("invalid RedirectStatusCode: %d", config.RedirectStatusCode))
+	}
+
+	if !isRedirectStatus(config.CanonicalStatusCode) {
+		errs = append(errs, fmt.Errorf("invalid CanonicalStatusCode: %d", config.CanonicalStatusCode))
+	}
+
+	if config.RedirectBody && !strings.Contains(config.RedirectBodyTemplate, "{location}") {
+		errs = append(errs, fmt.Errorf("redirectBodyTemplate must contain {location} when RedirectBody is enabled"))
+	}
+
+	if config.NotFoundRedirectPath != "" && !strings.HasPrefix(config.NotFoundRedirectPath, "/") {
+		errs = append(errs, fmt.Errorf("invalid NotFoundRedirectPath: %s", config.NotFoundRedirectPath))
+	}
+
+	if config.RejectUnsupportedPathLanguage && (config.RejectStatusCode < 400 || config.RejectStatusCode > 599) {
+		errs = append(errs, fmt.Errorf("invalid RejectStatusCode: %d", config.RejectStatusCode))
+	}
+
+	if config.RejectUnsupportedPathLanguage && len(config.RejectPathLanguages) == 0 {
+		errs = append(errs, fmt.Errorf("rejectPathLanguages is required when RejectUnsupportedPathLanguage is enabled"))
+	}
+
+	return errs
+}
+
+// validateCookieOptions checks that every feature relying on a cookie has its name.
+func validateCookieOptions(config *Config) []error {
+	var errs []error
+
+	if (config.LanguageStrategy == StrategyCookie || config.RememberPathLanguage) && config.CookieName == "" {
+		errs = append(errs, fmt.Errorf("cookieName is required when LanguageStrategy is 'cookie' or RememberPathLanguage is enabled"))
+	}
+
+	if config.FirstVisitOnly && config.FirstVisitCookieName == "" {
+		errs = append(errs, fmt.Errorf("firstVisitCookieName is required when FirstVisitOnly is enabled"))
+	}
+
+	if config.SessionScoped && config.SessionMarkerCookieName == "" {
+		errs = append(errs, fmt.Errorf("sessionMarkerCookieName is required when SessionScoped is enabled"))
+	}
+
+	if config.OverrideSecret != "" && config.OverrideCookieName == "" {
+		errs = append(errs, fmt.Errorf("overrideCookieName is required when OverrideSecret is set"))
+	}
+
+	return errs
+}
+
+// validatePickerOptions checks the language picker shown to clients matching nothing.
+func validatePickerOptions(config *Config) []error {
+	if !config.ShowPickerOnNoMatch {
+		return nil
+	}
+
+	var errs []error
+	if config.LanguageStrategy == StrategyHeader {
+		errs = append(errs, fmt.Errorf("invalid LanguageStrategy for ShowPickerOnNoMatch: %s", config.LanguageStrategy))
+	}
+	if !strings.Contains(config.PickerTemplate, "{links}") {
+		errs = append(errs, fmt.Errorf("pickerTemplate must contain {links} when ShowPickerOnNoMatch is enabled"))
+	}
+	return errs
+}
+
+// validateProxyOptions checks the proxies whose forwarded headers are trusted.
+func validateProxyOptions(config *Config) []error {
+	var errs []error
+	for _, proxy := range config.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			errs = append(errs, fmt.Errorf("invalid TrustedProxies: %s", proxy))
+		}
+	}
+	return errs
+}
+
+// validateLoggingOptions checks the format of the log output.
+func validateLoggingOptions(config *Config) []error {
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		return []error{fmt.Errorf("invalid LogFormat: %s", config.LogFormat)}
+	}
+	return nil
+}
+
+// validateMappedLanguages checks that every option mapping to or listing languages only uses supported ones.
+func validateMappedLanguages(config *Config) []error {
+	var errs []error
+
+	mappings := []struct {
+		option    string
+		languages map[string]string
+	}{
+		{option: "baseLanguageDefaults", languages: config.BaseLanguageDefaults},
+		{option: "expandBaseTo", languages: config.ExpandBaseTo},
+		{option: "regionGroups", languages: config.RegionGroups},
+		{option: "queryValueAliases", languages: config.QueryValueAliases},
+		{option: "languageAliases", languages: config.LanguageAliases},
+		{option: "countryLanguageMap", languages: config.CountryLanguageMap},
+	}
+	for _, mapping := range mappings {
+		for key, lang := range mapping.languages {
+			if !containsLanguage(config.Languages, lang) {
+				errs = append(errs, fmt.Errorf("%s: %s maps to unsupported language %s", mapping.option, key, lang))
+			}
+		}
+	}
+
+	for country, fallbacks := range config.CountryFallbacks {
+		errs = append(errs, unsupportedLanguages("countryFallbacks: "+country+" lists", fallbacks, config.Languages)...)
+	}
+
+	pathLanguages := make([]string, 0, len(config.PathLanguageMap))
+	for lang := range config.PathLanguageMap {
+		pathLanguages = append(pathLanguages, lang)
+	}
+	errs = append(errs, unsupportedLanguages("pathLanguageMap:", pathLanguages, config.Languages)...)
+	errs = append(errs, unsupportedLanguages("enforcedLanguages:", config.EnforcedLanguages, config.Languages)...)
+	errs = append(errs, unsupportedLanguages("fallbackLanguages:", config.FallbackLanguages, config.Languages)...)
+
+	for _, base := range config.CollapseToBase {
+		if !hasBaseLanguage(config.Languages, base) {
+			errs = append(errs, fmt.Errorf("collapseToBase: no configured language has the base %s", base))
+		}
+	}
+
+	return errs
+}
+
+// unsupportedLanguages returns an error prefixed with the option for every listed language that is not supported.
+func unsupportedLanguages(option string, listed, languages []string) []error {
+	var errs []error
+	for _, lang := range listed {
+		if !containsLanguage(languages, lang) {
+			errs = append(errs, fmt.Errorf("%s unsupported language %s", option, lang))
+		}
+	}
+	return errs
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (g *LangRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A handled header the client sent itself is no reason to skip and is not passed on
+	if g.config.SkipIfHandled && !g.isHandled(r) {
+		r.Header.Del(HandledHeader)
+	}
+
+	probe := g.isProbe(r)
+	if !probe && g.shouldSkip(r) {
+		g.next.ServeHTTP(w, r)
+		return
+	}
+
+	strategy, err := g.getStrategy()
+	if err != nil {
+		g.logEvent(logEntry{Action: "error", Error: err.Error()})
+		http.Error(w, g.config.ErrorBody, http.StatusInternalServerError)
+		return
+	}
+
+	// No content under a bogus language prefix
+	if !probe && g.rejectsPathLanguage(r) {
+		http.Error(w, http.StatusText(g.config.RejectStatusCode), g.config.RejectStatusCode)
+		return
+	}
+
+	g.handle(w, r, strategy, probe)
+}
+
+// handle detects the language of the request and applies it, with at most one redirect.
+func (g *LangRedirect) handle(w http.ResponseWriter, r *http.Request, strategy Strategy, probe bool) {
+	// Every URL change below is accumulated into a single redirect to the final target
+	n := &negotiation{strategy: strategy, original: r.URL.String(), status: g.config.RedirectStatusCode}
+
+	// Make a URL carrying different languages in the path and the query consistent
+	if !probe && g.reconcilePathQuery(r) {
+		n.redirectTo(g.config.CanonicalStatusCode)
+	}
+
+	language, source := g.detectLanguage(r, strategy)
+	n.language, n.source = language, source
+
+	// Read-only negotiation preview, nothing is written or redirected
+	if probe {
+		g.serveProbe(w, r, language, source)
+		return
+	}
+
+	// Clients matching nothing choose the language themselves instead of getting the default
+	if g.config.ShowPickerOnNoMatch && source == SourceDefault && g.canShowPicker(r, strategy) {
+		g.servePicker(w, r, strategy)
+		return
+	}
+
+	sessionHandled := g.isSessionHandled(r)
+	g.rememberLanguage(w, r, n)
+	g.markVisit(w, r, sessionHandled)
+	g.exposeLanguage(r, language, source)
+
+	g.applyLanguage(w, r, n, sessionHandled)
+	g.collapseRequestSlashes(r, n)
+	g.stripQueryAfterCookie(r, n)
+	g.stripDefaultQueryParam(r, n)
+
+	// A redirect would drop the submitted form
+	if source == SourceForm {
+		n.redirect = false
+	}
+
+	// Stop further execution with at most one redirect, never to the same URL
+	if n.redirect && g.canRedirect(r) && r.URL.String() != n.original {
+		g.redirect(w, r, language, n.original, n.status)
+		return
+	}
+
+	g.passOn(w, r, strategy, language)
+}
+
+// negotiation is the language of a handled request and the redirect its URL changes accumulate into.
+type negotiation struct {
+	strategy          Strategy
+	language          string
+	source            string
+	languageByRequest string
+	original          string
+	status            int
+	redirect          bool
+}
+
+// redirectTo requires a redirect with the status.
+func (n *negotiation) redirectTo(status int) {
+	n.redirect = true
+	n.status = status
+}
+
+// rejectsPathLanguage reports whether the request path starts with an unsupported language that must not be served.
+func (g *LangRedirect) rejectsPathLanguage(r *http.Request) bool {
+	return g.config.RejectUnsupportedPathLanguage && g.config.LanguageStrategy == StrategyPath && g.hasUnsupportedPathLanguage(r)
+}
+
+// rememberLanguage stores the language for later requests of the user.
+func (g *LangRedirect) rememberLanguage(w http.ResponseWriter, r *http.Request, n *negotiation) {
+	// Remember the language an identified user chose, a negotiated guess never becomes a preference
+	if key := g.preferenceKey(r); key != "" && isExplicitSource(n.source) {
+		g.store.Set(key, n.language)
+	}
+
+	// Remember the path language for later visits of paths without one
+	if g.config.RememberPathLanguage && g.config.LanguageStrategy == StrategyPath && g.allowsCookies(r) {
+		if lang := n.strategy.GetLanguage(r); lang != "" && !hasCookieValue(r, g.config.CookieName, lang) {
+			setLanguageCookie(w, g.config.CookieName, lang)
+		}
+	}
+}
+
+// markVisit sets the cookies marking the first visit and the handled session.
+func (g *LangRedirect) markVisit(w http.ResponseWriter, r *http.Request, sessionHandled bool) {
+	// Remember the first visit
+	if g.config.FirstVisitOnly && !hasCookie(r, g.config.FirstVisitCookieName) && g.allowsCookies(r) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     g.config.FirstVisitCookieName,
+			Value:    "1",
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	// Mark the session as handled, the browser drops the cookie when it closes
+	if g.config.SessionScoped && !sessionHandled {
+		http.SetCookie(w, &http.Cookie{
+			Name:     g.config.SessionMarkerCookieName,
+			Value:    "1",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// exposeLanguage exposes the detected language to downstream middlewares regardless of the strategy.
+func (g *LangRedirect) exposeLanguage(r *http.Request, language, source string) {
+	if g.config.PropagateHeader != "" {
+		r.Header.Set(g.config.PropagateHeader, g.formatBackendLanguage(language))
+	}
+	if g.config.SourceHeader != "" {
+		r.Header.Set(g.config.SourceHeader, g.sourceToken(language, source))
+	}
+}
+
+// applyLanguage writes the detected language to the request when it has to be handled.
+func (g *LangRedirect) applyLanguage(w http.ResponseWriter, r *http.Request, n *negotiation, sessionHandled bool) {
+	// Maybe lang already exist, as read by the read strategy, and what the write strategy already carries
+	strategy, language := n.strategy, n.language
+	languageByRequest, written := g.requestLanguage(r, strategy), strategy.GetLanguage(r)
+	nonCanonical := g.isNonCanonical(strategy, r, written)
+	n.languageByRequest = languageByRequest
+
+	switch {
+	case g.isCurrentLanguage(r, language):
+		// The request is already known to be in the detected language
+	case g.isDetectOnly(r):
+		// Deep links stay as they are, the language only reaches the backend as a header
+	case sessionHandled:
+		// The language was handled earlier in this browsing session
+	case g.shouldHandle(language) && (languageByRequest != language || written != language):
+		// Executing
+		strategy.SetLanguage(w, r, language)
+		g.redirectAfterHandling(n, g.config.RedirectStatusCode)
+	case nonCanonical && g.config.CanonicalizeURL:
+		// Keep the language the user already has, only fix its spelling
+		strategy.SetLanguage(w, r, languageByRequest)
+		n.redirectTo(g.config.CanonicalStatusCode)
+	case nonCanonical && g.shouldHandle(language):
+		// Replace an alias with the canonical code
+		strategy.SetLanguage(w, r, language)
+		g.redirectAfterHandling(n, g.config.CanonicalStatusCode)
+	}
+}
+
+// requestLanguage returns the language the request carries, as read by the read strategy.
+func (g *LangRedirect) requestLanguage(r *http.Request, strategy Strategy) string {
+	if g.readsRequestLanguage() {
+		strategy, _ = g.readStrategy(strategy)
+	}
+	return strategy.GetLanguage(r)
+}
+
+// redirectAfterHandling requires a redirect with the status when RedirectAfterHandling is enabled.
+func (g *LangRedirect) redirectAfterHandling(n *negotiation, status int) {
+	if g.config.RedirectAfterHandling {
+		n.redirectTo(status)
+	}
+}
+
+// collapseRequestSlashes collapses duplicate slashes of links or of the rewrite, the scheme separator is not part of
+// the path.
+func (g *LangRedirect) collapseRequestSlashes(r *http.Request, n *negotiation) {
+	if !g.config.CollapseSlashes || !strings.Contains(r.URL.Path, "//") {
+		return
+	}
+	r.URL.Path = collapseSlashes(r.URL.Path)
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = collapseSlashes(r.URL.RawPath)
+	}
+	// A cleanup on its own, an earlier redirect keeps its status
+	if !n.redirect {
+		g.redirectAfterHandling(n, g.config.CanonicalStatusCode)
+	}
+}
+
+// stripQueryAfterCookie drops the query param once the cookie carries the language chosen in the query.
+func (g *LangRedirect) stripQueryAfterCookie(r *http.Request, n *negotiation) {
+	if n.source != StrategyQuery || g.config.CookieOnly || g.config.QueryPersistence != QueryPersistenceStripAfterCookie ||
+		g.config.LanguageStrategy != StrategyCookie || n.strategy.GetLanguage(r) != n.language || !g.allowsCookies(r) {
+		return
+	}
+	queryStrategy, _ := g.newStrategy(StrategyQuery)
+	queryStrategy.(*QueryStrategy).removeLanguage(r)
+
+	// Only a cleanup when the cookie had the language already
+	switch {
+	case !g.config.RedirectAfterHandling:
+	case n.languageByRequest == n.language:
+		n.redirectTo(g.config.CanonicalStatusCode)
+	default:
+		n.redirect = true
+	}
+}
+
+// stripDefaultQueryParam keeps default language URLs clean, unless the param is what selected the default.
+func (g *LangRedirect) stripDefaultQueryParam(r *http.Request, n *negotiation) {
+	if !g.config.StripDefaultQueryParam || g.config.LanguageStrategy != StrategyQuery || g.config.DefaultLanguageHandling ||
+		n.language != g.config.DefaultLanguage || n.strategy.GetLanguage(r) != n.language || n.source == StrategyQuery {
+		return
+	}
+	n.strategy.(*QueryStrategy).removeLanguage(r)
+	n.redirectTo(g.config.CanonicalStatusCode)
+}
+
+// passOn passes the request on to the next handler in the applied language.
+func (g *LangRedirect) passOn(w http.ResponseWriter, r *http.Request, strategy Strategy, language string) {
+	// The no-redirect flag only applies to this request, it is not passed on
+	noRedirect := g.hasNoRedirectParam(r)
+	if noRedirect {
+		r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, g.config.NoRedirectParam)
+	}
+
+	r = g.upstreamRequest(w, r, strategy, language)
+
+	// The language cookie is only kept when the backend succeeds
+	deferred := g.deferLanguageCookies(w)
+	if deferred != nil {
+		w = deferred
+	}
+	w = g.upstreamWriter(w, r, language, noRedirect)
+
+	g.next.ServeHTTP(w, r)
+
+	// Nothing written is an implicit 200
+	if deferred != nil && !deferred.written {
+		deferred.WriteHeader(http.StatusOK)
+	}
+
+	if g.config.LanguageTrailer != "" {
+		w.Header().Set(g.config.LanguageTrailer, language)
+	}
+}
+
+// upstreamRequest returns the request routed with the applied language.
+func (g *LangRedirect) upstreamRequest(w http.ResponseWriter, r *http.Request, strategy Strategy, language string) *http.Request {
+	// The language the request is routed with, in sync with the rewritten path or query
+	applied := strategy.GetLanguage(r)
+	if applied == "" {
+		applied = language
+	}
+	if g.config.AlsoPropagateHeader != "" {
+		r.Header.Set(g.config.AlsoPropagateHeader, g.formatBackendLanguage(applied))
+	}
+
+	// The backend negotiates the same language, as with the header strategy
+	if g.config.OverwriteUpstreamAcceptLanguage && g.config.LanguageStrategy != StrategyHeader {
+		r.Header.Set("Accept-Language", applied)
+	}
+
+	// Point crawlers to the localized versions of the page
+	if g.config.EmitAlternateLinks {
+		for _, link := range g.alternateLinks(r, strategy) {
+			w.Header().Add("Link", link)
+		}
+	}
+
+	// Route to the virtual host of the language, the client URL stays as it is
+	if g.config.BackendHostTemplate != "" {
+		r.Host = strings.ReplaceAll(g.config.BackendHostTemplate, "{lang}", asciiLower(g.formatBackendLanguage(applied)))
+	}
+
+	// Later instances of the chain leave the request alone
+	if g.config.SkipIfHandled {
+		r.Header.Set(HandledHeader, g.name)
+		r = r.WithContext(context.WithValue(r.Context(), handledKey{}, g.name))
+	}
+	return r
+}
+
+// deferLanguageCookies returns a writer holding back the language cookies until the response status is known, nil
+// when there is none to hold back.
+func (g *LangRedirect) deferLanguageCookies(w http.ResponseWriter) *successWriter {
+	if !g.config.CookieOnSuccessOnly {
+		return nil
+	}
+	cookies := takeSetCookies(w.Header(), g.config.CookieName)
+	if len(cookies) == 0 {
+		return nil
+	}
+	return &successWriter{ResponseWriter: w, cookies: cookies}
+}
+
+// upstreamWriter returns the writer the next handler answers with.
+func (g *LangRedirect) upstreamWriter(w http.ResponseWriter, r *http.Request, language string, noRedirect bool) http.ResponseWriter {
+	// Send visitors of missing pages to the localized not-found page
+	if target := g.notFoundTarget(r, language); target != "" && !noRedirect {
+		w = &notFoundWriter{ResponseWriter: w, location: target, status: g.config.RedirectStatusCode}
+	}
+
+	// Streaming responses get the language after the body, the trailer is announced before anything is written
+	if g.config.LanguageTrailer != "" {
+		w.Header().Add("Trailer", g.config.LanguageTrailer)
+	}
+	return w
+}
+
+/* Helpers
+ * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// preferenceKey returns the key of the request in the preference store, empty when there is none.
+func (g *LangRedirect) preferenceKey(r *http.Request) string {
+	if g.store == nil || g.config.PreferenceKeyHeader == "" {
+		return ""
+	}
+	return r.Header.Get(g.config.PreferenceKeyHeader)
+}
+
+// reconcilePathQuery aligns different path and query languages according to PathQueryReconcile. It reports whether
+// the client has to be redirected to the consistent URL.
+func (g *LangRedirect) reconcilePathQuery(r *http.Request) bool {
+	if g.config.CookieOnly || g.config.PathQueryReconcile == ReconcileNone {
+		return false
+	}
+
+	pathStrategy, _ := g.newStrategy(StrategyPath)
+	queryStrategy, _ := g.newStrategy(StrategyQuery)
+
+	pathLanguage, queryLanguage := pathStrategy.GetLanguage(r), queryStrategy.GetLanguage(r)
+	if pathLanguage == "" || !containsLanguage(g.languages, queryLanguage) || pathLanguage == queryLanguage {
+		return false
+	}
+
+	switch g.config.PathQueryReconcile {
+	case ReconcilePathWins:
+		queryStrategy.SetLanguage(nil, r, pathLanguage)
+	case ReconcileQueryWins:
+		pathStrategy.SetLanguage(nil, r, queryLanguage)
+	case ReconcileRedirect:
+		// Keep only the representation of the configured strategy
+		if g.config.LanguageStrategy == StrategyQuery {
+			pathStrategy.(*PathStrategy).removeLanguage(r)
+		} else {
+			queryStrategy.(*QueryStrategy).removeLanguage(r)
+		}
+		return true
+	}
+	return false
+}
+
+// SignOverride returns the value of a language override cookie signed with the secret, "<language>.<hex HMAC-SHA256>".
+func SignOverride(secret, language string) string {
+	return language + "." + hex.EncodeToString(overrideSignature(secret, language))
+}
+
+func overrideSignature(secret, language string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(language))
+	return mac.Sum(nil)
+}
+
+// overrideLanguage returns the supported language of a correctly signed override cookie.
+func (g *LangRedirect) overrideLanguage(r *http.Request) (string, bool) {
+	if g.config.OverrideSecret == "" {
+		return "", false
+	}
+	cookie, err := r.Cookie(g.config.OverrideCookieName)
+	if err != nil {
+		return "", false
+	}
+	lang, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return "", false
+	}
+	decoded, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(decoded, overrideSignature(g.config.OverrideSecret, lang)) {
+		return "", false
+	}
+	return findLanguage(g.languages, lang)
+}
+
+// isCurrentLanguage reports whether the configured current language header carries the language.
+func (g *LangRedirect) isCurrentLanguage(r *http.Request, language string) bool {
+	return g.config.CurrentLanguageHeader != "" && asciiEqualFold(r.Header.Get(g.config.CurrentLanguageHeader), language)
+}
+
+// isSessionHandled reports whether the language was already handled in the browsing session of the request.
+func (g *LangRedirect) isSessionHandled(r *http.Request) bool {
+	return g.config.SessionScoped && hasCookie(r, g.config.SessionMarkerCookieName)
+}
+
+// isDetectOnly reports whether the request path starts with one of the detect-only paths.
+func (g *LangRedirect) isDetectOnly(r *http.Request) bool {
+	for _, prefix := range g.config.DetectOnlyPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldHandle reports whether the detected language has to be applied to the request.
+func (g *LangRedirect) shouldHandle(language string) bool {
+	if len(g.config.EnforcedLanguages) > 0 && !containsLanguage(g.config.EnforcedLanguages, language) {
+		return false
+	}
+	return language != "" && (language != g.config.DefaultLanguage || g.config.DefaultLanguageHandling)
+}
+
+// readsRequestLanguage reports whether Config.ReadStrategy reads the current language from the request itself, as
+// opposed to negotiating it from Accept-Language.
+func (g *LangRedirect) readsRequestLanguage() bool {
+	return g.config.ReadStrategy != "" && g.config.ReadStrategy != StrategyHeader
+}
+
+// readStrategy returns the strategy the current language is read with and its name, the LanguageStrategy unless
+// Config.ReadStrategy differs.
+func (g *LangRedirect) readStrategy(strategy Strategy) (Strategy, string) {
+	if g.config.ReadStrategy == "" || g.config.ReadStrategy == g.config.LanguageStrategy {
+		return strategy, g.config.LanguageStrategy
+	}
+	reader, _ := g.newStrategy(g.config.ReadStrategy)
+	return reader, g.config.ReadStrategy
+}
+
+// isNonCanonical reports whether the language in the request is spelled differently from its canonical code.
+// Aliases are always non-canonical, a different casing only when CanonicalizeURL is enabled.
+func (g *LangRedirect) isNonCanonical(strategy Strategy, r *http.Request, languageByRequest string) bool {
+	raw := rawLanguage(strategy, r)
+	if raw == languageByRequest {
+		return false
+	}
+	return g.config.CanonicalizeURL || !asciiEqualFold(raw, languageByRequest)
+}
+
+// detectLanguage returns the language to use for the request and the signal it was taken from.
+func (g *LangRedirect) detectLanguage(r *http.Request, strategy Strategy) (string, string) {
+	if lang, source, ok := g.requestedLanguage(r, strategy); ok {
+		return lang, source
+	}
+	if lang, source, ok := g.rememberedLanguage(r, strategy); ok {
+		return lang, source
+	}
+
+	acceptLanguage := g.acceptLanguage(r)
+	language, source := g.getPreferredLanguage(acceptLanguage)
+
+	// Weak signals, only when Accept-Language has no match
+	if source == SourceFallback || source == SourceDefault {
+		if lang, countrySource, ok := g.countryLanguage(r, acceptLanguage); ok {
+			language, source = lang, countrySource
+		} else if lang, ok := g.refererLanguage(r); ok {
+			language, source = lang, SourceReferer
+		}
+	}
+
+	return g.collapseLanguage(language), source
+}
+
+// requestedLanguage returns the language explicitly chosen for the request and its source.
+func (g *LangRedirect) requestedLanguage(r *http.Request, strategy Strategy) (string, string, bool) {
+	// Maintenance mode, nothing else counts
+	if g.config.ForceLanguage != "" {
+		return g.config.ForceLanguage, SourceForced, true
+	}
+
+	// A trusted override set by the application, ignored unless its signature is valid
+	if lang, ok := g.overrideLanguage(r); ok {
+		return lang, SourceOverride, true
+	}
+
+	// A language submitted with a form, e.g. on login
+	if g.config.ReadFormLanguage {
+		if lang, ok := findLanguage(g.languages, formLanguage(r, g.config.FormLanguageField)); ok {
+			return lang, SourceForm, true
+		}
+	}
+
+	// With the cookie strategy a language in the query is a deliberate switch
+	if g.config.LanguageStrategy == StrategyCookie {
+		if lang, ok := findLanguage(g.languages, r.URL.Query().Get(g.config.LanguageParam)); ok {
+			return lang, StrategyQuery, true
+		}
+	}
+
+	if g.prefersRequestLanguage(r) {
+		reader, source := g.readStrategy(strategy)
+		if languageByRequest := reader.GetLanguage(r); containsLanguage(g.languages, languageByRequest) {
+			return languageByRequest, source, true
+		}
+	}
+
+	return "", "", false
+}
+
+// prefersRequestLanguage reports whether the language in the request wins over Accept-Language. An explicit choice
+// does, as does the current language of a returning visitor, a URL language navigated to despite a stored language
+// cookie and the language of a dedicated read strategy.
+func (g *LangRedirect) prefersRequestLanguage(r *http.Request) bool {
+	return g.config.ExplicitOverridesHeader ||
+		(g.config.FirstVisitOnly && hasCookie(r, g.config.FirstVisitCookieName)) ||
+		(g.config.ExplicitPathOverridesCookie && g.hasURLLanguage() && g.hasLanguageCookie(r)) ||
+		g.readsRequestLanguage()
+}
+
+// rememberedLanguage returns the language stored for the user by an earlier request and its source.
+func (g *LangRedirect) rememberedLanguage(r *http.Request, strategy Strategy) (string, string, bool) {
+	// The stored choice of the user wins over Accept-Language
+	if g.config.CookiePrecedence {
+		if lang, ok := g.storedCookieLanguage(r, strategy); ok {
+			return lang, SourceCookie, true
+		}
+	}
+
+	// The path language of an earlier visit, for paths without one
+	if g.config.RememberPathLanguage && g.config.LanguageStrategy == StrategyPath && strategy.GetLanguage(r) == "" {
+		if cookie, err := r.Cookie(g.config.CookieName); err == nil {
+			if lang, ok := findLanguage(g.languages, cookie.Value); ok {
+				return lang, SourceCookie, true
+			}
+		}
+	}
+
+	// Server-side remembered preference of an identified user
+	if key := g.preferenceKey(r); key != "" {
+		if lang, ok := g.store.Get(key); ok && containsLanguage(g.languages, lang) {
+			return lang, SourceStore, true
+		}
+	}
+
+	return "", "", false
+}
+
+// acceptLanguage returns the first non-empty of the Accept-Language headers, preceded by the client hint languages if
+// enabled.
+func (g *LangRedirect) acceptLanguage(r *http.Request) string {
+	var acceptLanguage string
+	for _, name := range g.config.AcceptLanguageHeaders {
+		if acceptLanguage = r.Header.Get(name); acceptLanguage != "" {
+			break
+		}
+	}
+	if !g.config.UseClientHints {
+		return acceptLanguage
+	}
+	hints := clientHintLanguages(r.Header.Get(ClientHintLanguageHeader))
+	if hints == "" {
+		return acceptLanguage
+	}
+	if acceptLanguage == "" {
+		return hints
+	}
+	return hints + "," + acceptLanguage
+}
+
+// clientHintLanguages converts the structured list of a language client hint ("de", "en") to Accept-Language
+// entries of full quality, keeping their order.
+func clientHintLanguages(hint string) string {
+	var languages []string
+	for _, item := range strings.Split(hint, ",") {
+		item, _, _ = strings.Cut(item, ";")
+		if lang := strings.Trim(strings.TrimSpace(item), `"`); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return strings.Join(languages, ",")
+}
+
+// storedCookieLanguage returns the supported language of the language cookie, read as the cookie strategy does.
+func (g *LangRedirect) storedCookieLanguage(r *http.Request, strategy Strategy) (string, bool) {
+	if g.config.LanguageStrategy == StrategyCookie {
+		return findLanguage(g.languages, strategy.GetLanguage(r))
+	}
+	cookie, err := r.Cookie(g.config.CookieName)
+	if err != nil {
+		return "", false
+	}
+	return findLanguage(g.languages, cookie.Value)
+}
+
+// hasURLLanguage reports whether the strategy carries the language in the URL.
+func (g *LangRedirect) hasURLLanguage() bool {
+	return g.config.LanguageStrategy == StrategyPath || g.config.LanguageStrategy == StrategyQuery
+}
+
+// hasLanguageCookie reports whether the language cookie holds a supported language.
+func (g *LangRedirect) hasLanguageCookie(r *http.Request) bool {
+	cookie, err := r.Cookie(g.config.CookieName)
+	return err == nil && containsLanguage(g.languages, cookie.Value)
+}
+
+// hasUnsupportedPathLanguage reports whether the language segment position of the path holds a language code that is
+// not supported.
+func (g *LangRedirect) hasUnsupportedPathLanguage(r *http.Request) bool {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	segment := segments[0]
+	if g.config.PathPosition == PathPositionSuffix {
+		segment = segments[len(segments)-1]
+	}
+	if _, ok := findLanguage(g.languages, segment); ok {
+		return false
+	}
+	// Ordinary segments are often valid language codes (my, id, no, uk), only the listed ones are rejected
+	return coversLanguage(g.config.RejectPathLanguages, segment)
+}
+
+// notFoundTarget returns the localized not-found page a 404 response of the request is redirected to, empty when
+// disabled or when the request is for that page already.
+func (g *LangRedirect) notFoundTarget(r *http.Request, language string) string {
+	if g.config.NotFoundRedirectPath == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) || !g.canRedirect(r) {
+		return ""
+	}
+	target := strings.ReplaceAll(g.config.NotFoundRedirectPath, "{lang}", language)
+	if targetPath, _, _ := strings.Cut(target, "?"); targetPath == r.URL.Path {
+		return ""
+	}
+	return target
+}
+
+// notFoundWriter is a response writer replacing a 404 response of the next handler with a redirect.
+type notFoundWriter struct {
+	http.ResponseWriter
+	location   string
+	status     int
+	redirected bool
+	written    bool
+}
+
+func (w *notFoundWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if status != http.StatusNotFound {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.redirected = true
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Type")
+	header.Set("Location", w.location)
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// Write drops the body of a redirected 404 response.
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.redirected {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *notFoundWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the original writer to http.ResponseController.
+func (w *notFoundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// takeSetCookies removes the Set-Cookie headers of the named cookie and returns them.
+func takeSetCookies(header http.Header, name string) []string {
+	var taken, kept []string
+	for _, value := range header.Values("Set-Cookie") {
+		if strings.HasPrefix(value, name+"=") {
+			taken = append(taken, value)
+		} else {
+			kept = append(kept, value)
+		}
+	}
+	if len(taken) > 0 {
+		header.Del("Set-Cookie")
+		for _, value := range kept {
+			header.Add("Set-Cookie", value)
+		}
+	}
+	return taken
+}
+
+// successWriter is a response writer adding the deferred Set-Cookie headers only to a successful (2xx or 3xx)
+// response of the next handler.
+type successWriter struct {
+	http.ResponseWriter
+	cookies []string
+	written bool
+}
+
+func (w *successWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if status < http.StatusBadRequest {
+		for _, cookie := range w.cookies {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *successWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *successWriter) Flush() {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the original writer to http.ResponseController.
+func (w *successWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// maxFormBytes limits the form body buffered to read the form language.
+const maxFormBytes = 64 << 10
+
+// replayBody is a request body whose start was already read and buffered.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// formLanguage returns the field of an urlencoded form body. The body is restored for the next handler, bodies larger
+// than maxFormBytes are not parsed.
+func formLanguage(r *http.Request, field string) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(r.Body, maxFormBytes+1))
+	r.Body = replayBody{Reader: io.MultiReader(bytes.NewReader(buffered), r.Body), Closer: r.Body}
+	if err != nil || len(buffered) > maxFormBytes {
+		return ""
+	}
+
+	values, err := url.ParseQuery(string(buffered))
+	if err != nil {
+		return ""
+	}
+	return values.Get(field)
+}
+
+// countryLanguage returns the language mapped to the client country, or else the first of its fallback languages the
+// client has not rejected (q=0), along with the source.
+func (g *LangRedirect) countryLanguage(r *http.Request, acceptLanguage string) (string, string, bool) {
+	country, ok := g.country(r)
+	if !ok {
+		return "", "", false
+	}
+	country = asciiUpper(country)
+	if lang, ok := g.countries[country]; ok {
+		return lang, SourceGeo, true
+	}
+	if fallbacks := g.countryFallbacks[country]; len(fallbacks) > 0 {
+		languages := parseAcceptLanguage(acceptLanguage, g.config.MaxLanguageEntries, g.config.NormalizeUnderscores)
+		for _, lang := range fallbacks {
+			if !isRejected(languages, lang) {
+				return lang, SourceCountryFallback, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// country returns the client country from the country header, or from the resolver by the client IP.
+func (g *LangRedirect) country(r *http.Request) (string, bool) {
+	if g.config.CountryHeader != "" && g.trustsForwardedHeaders(r) {
+		if country := strings.TrimSpace(r.Header.Get(g.config.CountryHeader)); country != "" {
+			return country, true
+		}
+	}
+	if g.resolver == nil {
+		return "", false
+	}
+
+	ip := g.clientIP(r)
+	if g.geoCache != nil {
+		if country, ok, found := g.geoCache.get(ip); found {
+			return country, ok
+		}
+	}
+	country, ok := g.resolver.Country(ip)
+	if g.geoCache != nil {
+		g.geoCache.set(ip, country, ok)
+	}
+	return country, ok
+}
+
+// clientIP returns the IP of the client connection, or the forwarded client IP when it is a trusted proxy.
+func (g *LangRedirect) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if len(g.proxies) == 0 || !g.isTrustedProxy(ip) {
+		return ip
+	}
+	// The client is the last address not added by a trusted proxy
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if !g.isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// trustsForwardedHeaders reports whether the request comes from a trusted proxy, or any proxy when none is configured.
+func (g *LangRedirect) trustsForwardedHeaders(r *http.Request) bool {
+	return len(g.proxies) == 0 || g.isTrustedProxy(remoteIP(r))
+}
+
+func (g *LangRedirect) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range g.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy parses a CIDR range, a bare IP is a single address range.
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %s", proxy)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(proxy)
+	return network, err
+}
+
+// geoCache is a bounded, concurrency-safe TTL cache of resolved countries keyed by IP. When full, the oldest entry is
+// evicted.
+type geoCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type geoEntry struct {
+	ip      string
+	country string
+	ok      bool
+	expires time.Time
+}
+
+func newGeoCache(ttl time.Duration, size int) *geoCache {
+	return &geoCache{ttl: ttl, size: size, entries: make(map[string]*list.Element, size), order: list.New()}
+}
+
+// get returns the cached resolution of the IP, found is false if it is missing or expired.
+func (c *geoCache) get(ip string) (country string, ok, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[ip]
+	if !found {
+		return "", false, false
+	}
+	entry := element.Value.(*geoEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, ip)
+		return "", false, false
+	}
+	return entry.country, entry.ok, true
+}
+
+func (c *geoCache) set(ip, country string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[ip]; found {
+		c.order.Remove(element)
+		delete(c.entries, ip)
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*geoEntry).ip)
+	}
+	c.entries[ip] = c.order.PushBack(&geoEntry{ip: ip, country: country, ok: ok, expires: time.Now().Add(c.ttl)})
+}
+
+// refererLanguage returns the path language of a Referer on the same host.
+func (g *LangRedirect) refererLanguage(r *http.Request) (string, bool) {
+	if !g.config.UseRefererLanguage {
+		return "", false
+	}
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Path == "" || !strings.EqualFold(referer.Host, g.requestHost(r)) {
+		return "", false
+	}
+	path := &PathStrategy{position: g.config.PathPosition, languages: g.languages}
+	segments, index := path.languageSegment(referer.Path)
+	if index < 0 {
+		return "", false
+	}
+	return findLanguage(g.languages, segments[index])
+}
+
+func (g *LangRedirect) getPreferredLanguage(acceptLanguage string) (string, string) {
+	languages := parseAcceptLanguage(acceptLanguage, g.config.MaxLanguageEntries, g.config.NormalizeUnderscores)
+	for i, entry := range languages {
+		if lang, ok := g.aliases[entry.tag]; ok {
+			languages[i].tag = lang
+		}
+	}
+	if g.matcher != nil {
+		return g.matchStrict(languages)
+	}
+	// Noise languages are only considered when nothing else matches
+	preferred, noise := g.partitionIgnored(languages)
+	for _, candidates := range [][]languageRange{preferred, noise} {
+		if lang, ok := g.matchRanges(candidates); ok {
+			return lang, SourceHeader
+		}
+	}
+	return g.getFallbackLanguage(languages)
+}
+
+// partitionIgnored splits quality ordered ranges into the regular ones and those of Config.IgnoreLanguages.
+func (g *LangRedirect) partitionIgnored(languages []languageRange) ([]languageRange, []languageRange) {
+	if len(g.config.IgnoreLanguages) == 0 {
+		return languages, nil
+	}
+	var preferred, noise []languageRange
+	for _, entry := range languages {
+		if coversLanguage(g.config.IgnoreLanguages, entry.tag) {
+			noise = append(noise, entry)
+		} else {
+			preferred = append(preferred, entry)
+		}
+	}
+	return preferred, noise
+}
+
+// coversLanguage reports whether the tag is one of the listed languages, a bare listed base covers all its regions.
+func coversLanguage(languages []string, tag string) bool {
+	for _, listed := range languages {
+		if asciiEqualFold(tag, listed) || (!strings.Contains(listed, "-") && asciiEqualFold(baseLanguage(tag), listed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRanges returns the supported language of the first matching range.
+func (g *LangRedirect) matchRanges(languages []languageRange) (string, bool) {
+	// Bases whose fallback already failed for a higher entry (en-US), later variants (en-GB, en) are not retried. A
+	// script is part of the base, zh-Hans-CN is still tried after zh-Hant-TW failed
+	var failedBases map[string]bool
+	for i, entry := range languages {
+		if entry.quality <= 0 {
+			break
+		}
+		base := fallbackBase(entry.tag)
+		if _, exact := g.lookup[entry.tag]; !exact && failedBases[base] {
+			continue
+		}
+		lang, ok := g.matchRange(entry.tag)
+		if !ok {
+			if base != entry.tag {
+				if failedBases == nil {
+					failedBases = make(map[string]bool)
+				}
+				failedBases[base] = true
+			}
+			continue
+		}
+		return g.preferredMatch(lang, entry, languages[i+1:]), true
+	}
+	return "", false
+}
+
+// preferredMatch returns the language matching the entry, or the one of the following entries preferred over it.
+func (g *LangRedirect) preferredMatch(lang string, entry languageRange, following []languageRange) string {
+	if g.config.PreferExactRegion && !isExactRegionMatch(entry.tag, lang) {
+		if regional, ok := g.exactRegion(entry.quality, following); ok {
+			return regional
+		}
+	}
+	if g.config.PreferConfigOrder || len(g.weights) > 0 {
+		lang = g.breakTie(lang, entry.quality, following)
+	}
+	return lang
+}
+
+// matchRange returns the supported language matching an Accept-Language tag.
+func (g *LangRedirect) matchRange(tag string) (string, bool) {
+	if supported, ok := g.lookup[tag]; ok {
+		return supported, true
+	}
+	// Any supported language is fine, bare or weighted
+	if tag == "*" {
+		return g.heaviestLanguage(), true
+	}
+	if grouped, ok := g.groupedRegion(tag); ok {
+		return grouped, true
+	}
+	// A script is significant, zh-Hant-TW falls back to zh-Hant but never to a zh-Hans default
+	if script := fallbackBase(tag); script != tag {
+		if supported, ok := g.lookup[script]; ok {
+			return supported, true
+		}
+	}
+	// Fall back to the base subtag (en-ZZ -> en) or its configured regional default, a base-only match is expanded to
+	// its full locale
+	base := baseLanguage(tag)
+	if expanded, ok := g.expansions[base]; ok && sameScript(tag, expanded) {
+		return expanded, true
+	}
+	if base == tag {
+		return "", false
+	}
+	if supported, ok := g.lookup[base]; ok {
+		return supported, true
+	}
+	if regional, ok := g.config.BaseLanguageDefaults[base]; ok && sameScript(tag, regional) {
+		return regional, true
+	}
+	return "", false
+}
+
+// groupedRegion returns the business-preferred locale shared by the regions of a group (es-MX -> es-419), for tags
+// of the same language and script.
+func (g *LangRedirect) groupedRegion(tag string) (string, bool) {
+	grouped, ok := g.regionGroups[regionSubtag(tag)]
+	return grouped, ok && baseLanguage(tag) == baseLanguage(normalizeTag(grouped)) && sameScript(tag, grouped)
+}
+
+// exactRegionWindow is how much lower the quality of an exact regional match may be to win over a base-only match.
+const exactRegionWindow = 0.1
+
+// exactRegion returns the first of the following entries that exactly matches a regional language within
+// exactRegionWindow of quality.
+func (g *LangRedirect) exactRegion(quality float64, following []languageRange) (string, bool) {
+	for _, entry := range following {
+		if entry.quality <= 0 || quality-entry.quality > exactRegionWindow+1e-9 {
+			break
+		}
+		if lang, ok := g.lookup[entry.tag]; ok && isExactRegionMatch(entry.tag, lang) {
+			return lang, true
+		}
+	}
+	return "", false
+}
+
+// isExactRegionMatch reports whether a tag with more than a base language matched a supported language exactly.
+func isExactRegionMatch(tag, lang string) bool {
+	return strings.Contains(tag, "-") && asciiEqualFold(tag, lang)
+}
+
+// breakTie resolves a quality tie with the following entries by the language weights, then by the order of
+// Config.Languages if enabled.
+func (g *LangRedirect) breakTie(lang string, quality float64, following []languageRange) string {
+	for _, entry := range following {
+		if entry.quality != quality {
+			break
+		}
+		if tied, ok := g.matchRange(entry.tag); ok && g.prefers(tied, lang) {
+			lang = tied
+		}
+	}
+	return lang
+}
+
+// prefers reports whether the server prefers language a over b.
+func (g *LangRedirect) prefers(a, b string) bool {
+	if weightA, weightB := g.weight(a), g.weight(b); weightA != weightB {
+		return weightA > weightB
+	}
+	return g.config.PreferConfigOrder && g.rank[a] < g.rank[b]
+}
+
+// weight returns the server-side weight of a supported language, 1 unless configured.
+func (g *LangRedirect) weight(lang string) float64 {
+	if weight, ok := g.weights[lang]; ok {
+		return weight
+	}
+	return 1
+}
+
+// heaviestLanguage returns the supported language with the highest weight, the first configured one for equal weights.
+func (g *LangRedirect) heaviestLanguage() string {
+	heaviest := g.config.Languages[0]
+	for _, lang := range g.config.Languages[1:] {
+		if g.weight(lang) > g.weight(heaviest) {
+			heaviest = lang
+		}
+	}
+	return heaviest
+}
+
+// parseLanguageWeights splits weighted entries of the languages ("en;w=2") into the languages and their weights.
+func parseLanguageWeights(entries []string) ([]string, map[string]float64, error) {
+	var errs []error
+	languages := make([]string, 0, len(entries))
+	weights := map[string]float64{}
+	for _, entry := range entries {
+		lang, param, ok := strings.Cut(entry, ";")
+		lang = strings.TrimSpace(lang)
+		languages = append(languages, lang)
+		if !ok {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !strings.EqualFold(strings.TrimSpace(name), "w") || err != nil || weight <= 0 {
+			errs = append(errs, fmt.Errorf("languages: invalid weight in %s", entry))
+			continue
+		}
+		weights[lang] = weight
+	}
+	return languages, weights, joinErrors(errs...)
+}
+
+// getFallbackLanguage returns the first fallback language the client has not rejected (q=0), or the default.
+func (g *LangRedirect) getFallbackLanguage(languages []languageRange) (string, string) {
+	for _, fallback := range g.config.FallbackLanguages {
+		if !isRejected(languages, fallback) {
+			return fallback, SourceFallback
+		}
+	}
+	return g.config.DefaultLanguage, SourceDefault
+}
+
+func isRejected(languages []languageRange, lang string) bool {
+	for _, entry := range languages {
+		if entry.quality <= 0 && (asciiEqualFold(entry.tag, lang) || asciiEqualFold(entry.tag, baseLanguage(lang))) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBackendLanguage formats the language for the backend-facing header, mapping the URL code to the content code
+// and dropping regions and scripts for iso639-1.
+func (g *LangRedirect) formatBackendLanguage(lang string) string {
+	if content, ok := g.config.PathLanguageMap[lang]; ok {
+		lang = content
+	}
+	if g.config.BackendLanguageFormat == BackendFormatISO6391 {
+		return asciiLower(baseLanguage(lang))
+	}
+	return lang
+}
+
+// collapseLanguage reduces the language to its base when the base is configured to be collapsed.
+func (g *LangRedirect) collapseLanguage(lang string) string {
+	if base := baseLanguage(lang); containsLanguage(g.config.CollapseToBase, base) {
+		return base
+	}
+	return lang
+}
+
+func hasBaseLanguage(languages []string, base string) bool {
+	for _, lang := range languages {
+		if baseLanguage(lang) == base {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueLanguages removes duplicates preserving the first-seen order, ok is false if any were found.
+func uniqueLanguages(languages []string) ([]string, bool) {
+	unique := make([]string, 0, len(languages))
+	for _, lang := range languages {
+		if !containsLanguage(unique, lang) {
+			unique = append(unique, lang)
+		}
+	}
+	return unique, len(unique) == len(languages)
+}
+
+// newStrictMatcher builds a golang.org/x/text matcher, the index of a match is the index in languages.
+func newStrictMatcher(languages []string) language.Matcher {
+	tags := make([]language.Tag, 0, len(languages))
+	for _, lang := range languages {
+		tags = append(tags, language.Make(lang))
+	}
+	return language.NewMatcher(tags)
+}
+
+// matchStrict negotiates with the x/text matcher, which handles macro-languages and script inference.
+func (g *LangRedirect) matchStrict(languages []languageRange) (string, string) {
+	tags := make([]language.Tag, 0, len(languages))
+	for _, lang := range languages {
+		if lang.quality <= 0 {
+			break
+		}
+		if tag, err := language.Parse(lang.tag); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		if _, index, confidence := g.matcher.Match(tags...); confidence != language.No {
+			return g.config.Languages[index], SourceHeader
+		}
+	}
+	return g.getFallbackLanguage(languages)
+}
+
+// findLanguage returns the configured form of lang, matched case-insensitively.
+func findLanguage(languages []string, lang string) (string, bool) {
+	for _, supportedLang := range languages {
+		if asciiEqualFold(lang, supportedLang) {
+			return supportedLang, true
+		}
+	}
+	return "", false
+}
+
+func containsLanguage(languages []string, lang string) bool {
+	for _, supportedLang := range languages {
+		if lang == supportedLang {
+			return true
+		}
+	}
+	return false
+}
+
+// baseLanguage returns the primary subtag of a language tag, e.g. "en" for "en-US".
+func baseLanguage(tag string) string {
+	base, _, _ := strings.Cut(tag, "-")
+	return base
+}
+
+// fallbackBase returns the language and script subtags of a normalized tag with a script (zh-Hant for zh-Hant-TW),
+// the primary subtag otherwise.
+func fallbackBase(tag string) string {
+	if script := scriptSubtag(tag); script != "" {
+		return baseLanguage(tag) + "-" + script
+	}
+	return baseLanguage(tag)
+}
+
+// scriptSubtag returns the script subtag of a language tag (Hant for zh-Hant-TW), empty when it has none.
+func scriptSubtag(tag string) string {
+	subtags := strings.SplitN(tag, "-", 3)
+	if len(subtags) < 2 || len(subtags[1]) != 4 || !isAlpha(subtags[1]) {
+		return ""
+	}
+	return subtags[1]
+}
+
+// regionSubtag returns the region subtag of a normalized language tag (MX for es-MX, 419 for es-419), empty when it
+// has none.
+func regionSubtag(tag string) string {
+	subtags := strings.SplitN(tag, "-", 4)
+	if len(subtags) > 2 && scriptSubtag(tag) != "" {
+		subtags = subtags[1:]
+	}
+	if len(subtags) < 2 {
+		return ""
+	}
+	if region := subtags[1]; len(region) == 2 && isAlpha(region) || len(region) == 3 && isDigits(region) {
+		return region
+	}
+	return ""
+}
+
+// sameScript reports whether a supported language does not name a script other than the one of the tag.
+func sameScript(tag, lang string) bool {
+	script, other := scriptSubtag(tag), scriptSubtag(lang)
+	return script == "" || other == "" || asciiEqualFold(script, other)
+}
+
+// languageRange is an Accept-Language entry.
+type languageRange struct {
+	tag     string
+	quality float64
+}
+
+// parseAcceptLanguage returns at most maxEntries language ranges ordered by quality, the rest of the header is ignored.
+// Entries with the same quality keep the header order, unacceptable (q=0) entries come last.
+// With normalizeUnderscores, tags of misbehaving clients (en_US) are read as BCP 47 tags (en-US).
+func parseAcceptLanguage(acceptLanguage string, maxEntries int, normalizeUnderscores bool) []languageRange {
+	parts := strings.SplitN(acceptLanguage, ",", maxEntries+1)
+	if len(parts) > maxEntries {
+		parts = parts[:maxEntries]
+	}
+	languages := make([]languageRange, 0, len(parts))
+	for _, part := range parts {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if normalizeUnderscores {
+			tag = strings.ReplaceAll(tag, "_", "-")
+		}
+		if isNoPreference(tag) {
+			continue
+		}
+		languages = append(languages, languageRange{tag: normalizeTag(tag), quality: parseQuality(params)})
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	return uniqueRanges(languages)
+}
+
+// uniqueRanges drops repeated tags of quality ordered ranges, keeping the highest quality of each.
+func uniqueRanges(languages []languageRange) []languageRange {
+	unique := languages[:0]
+	for _, entry := range languages {
+		duplicate := false
+		for _, kept := range unique {
+			if kept.tag == entry.tag {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, entry)
+		}
+	}
+	return unique
+}
+
+// normalizeTag applies the BCP 47 casing conventions: lowercase language, title-case script and uppercase region,
+// e.g. "zh-Hans-CN" for "ZH-HANS-cn". Subtags after a singleton (extensions, private use) are lowercased.
+func normalizeTag(tag string) string {
+	// Copied on the first change only, a tag in canonical form is returned as is
+	var normalized []byte
+	singleton := false
+	for i, start := 0, 0; start <= len(tag); i++ {
+		end := strings.IndexByte(tag[start:], '-')
+		if end < 0 {
+			end = len(tag)
+		} else {
+			end += start
+		}
+		var upper int
+		upper, singleton = subtagCasing(i, tag[start:end], singleton)
+		for j := start; j < end; j++ {
+			if c := caseASCII(tag[j], j-start < upper); c != tag[j] {
+				if normalized == nil {
+					normalized = []byte(tag)
+				}
+				normalized[j] = c
+			}
+		}
+		start = end + 1
+	}
+	if normalized == nil {
+		return tag
+	}
+	return string(normalized)
+}
+
+// subtagCasing returns the number of leading letters of the subtag at the index to uppercase, the rest is lowercased,
+// and whether the extensions started with it or an earlier singleton.
+func subtagCasing(index int, subtag string, extension bool) (int, bool) {
+	switch {
+	case index == 0 || extension:
+		return 0, extension
+	case len(subtag) == 1:
+		return 0, true
+	case len(subtag) == 4 && isAlpha(subtag):
+		return 1, false
+	case len(subtag) == 2:
+		return 2, false
+	}
+	return 0, false
+}
+
+// caseASCII upper- or lowercases an ASCII letter, any other byte is returned as is.
+func caseASCII(c byte, upper bool) byte {
+	if !upper {
+		return lowerASCII(c)
+	}
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// asciiLower lowercases the ASCII letters of s only. Language tags are ASCII, so unlike strings.ToLower no Unicode
+// case mapping applies and non-ASCII input never folds into a configured code.
+func asciiLower(s string) string {
+	return mapASCII(s, 'A', 'Z', 'a'-'A')
+}
+
+// asciiUpper uppercases the ASCII letters of s only, see asciiLower.
+func asciiUpper(s string) string {
+	return mapASCII(s, 'a', 'z', 'A'-'a')
+}
+
+func mapASCII(s string, lo, hi byte, delta int) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= lo && c <= hi {
+			if b == nil {
+				b = []byte(s)
+			}
+			b[i] = byte(int(c) + delta)
+		}
+	}
+	if b == nil {
+		return s
+	}
+	return string(b)
+}
+
+// asciiEqualFold reports whether a and b are equal under ASCII case folding. Unlike strings.EqualFold, the Kelvin
+// sign or the long s do not match "k" and "s".
+func asciiEqualFold(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if lowerASCII(a[i]) != lowerASCII(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
 
-// Config the plugin configuration.
-type Config struct {
-	Languages               []string `yaml:"languages"`
-	DefaultLanguage         string   `yaml:"defaultLanguage"`
-	DefaultLanguageHandling bool     `yaml:"defaultLanguageHandling"`
-	LanguageStrategy        string   `yaml:"languageStrategy"`
-	LanguageParam           string   `yaml:"languageParam"`
-	RedirectAfterHandling   bool     `yaml:"redirectAfterHandling"`
+func isAlpha(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
 }
 
-// CreateConfig creates the default plugin configuration.
-func CreateConfig() *Config {
-	return &Config{
-		Languages:               []string{},
-		DefaultLanguage:         "",
-		DefaultLanguageHandling: false,
-		LanguageStrategy:        "header",
-		LanguageParam:           "lang",
-		RedirectAfterHandling:   false,
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
 	}
+	return true
 }
 
-// LangRedirect a plugin.
-type LangRedirect struct {
-	next   http.Handler
-	config *Config
+// isNoPreference reports whether the tag carries no actual language: undetermined, default or multiple languages.
+func isNoPreference(tag string) bool {
+	return asciiEqualFold(baseLanguage(tag), "und") || asciiEqualFold(tag, "i-default") || asciiEqualFold(tag, "mul")
 }
 
-// New creates a new plugin.
-func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.Languages) == 0 {
-		return nil, fmt.Errorf("languages are required")
+// parseQuality extracts the q parameter, tolerating whitespace and case (" Q = 0.9") as well as the integer values of
+// legacy clients (q=1). Out of range values are clamped to [0, 1]. Defaults to 1.0.
+func parseQuality(params string) float64 {
+	for params != "" {
+		var param string
+		param, params, _ = strings.Cut(params, ";")
+		key, value, found := strings.Cut(param, "=")
+		if !found || !asciiEqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || math.IsNaN(quality) {
+			continue
+		}
+		return math.Max(0, math.Min(1, quality))
 	}
+	return 1.0
+}
 
-	if config.DefaultLanguage == "" {
-		return nil, fmt.Errorf("DefaultLanguage is required")
+// shouldSkip reports whether the request must be passed through without any language handling.
+func (g *LangRedirect) shouldSkip(r *http.Request) bool {
+	// A redirect breaks the WebSocket handshake
+	if isWebSocketUpgrade(r) {
+		return true
+	}
+	// Proxy-style requests (CONNECT, authority or asterisk form) have no path to localize
+	if r.Method == http.MethodConnect || !strings.HasPrefix(r.URL.Path, "/") {
+		return true
 	}
+	// Leave XHR/fetch and asset requests alone
+	if g.config.OnlyDocumentRequests && !isDocumentRequest(r) {
+		return true
+	}
+	// Static assets are not localized
+	if isExcludedExtension(r.URL.Path, g.config.ExcludedExtensions) {
+		return true
+	}
+	// Logged-in flows handle the language themselves
+	if g.config.SkipAuthenticated && isAuthenticated(r, g.config.SessionCookieName) {
+		return true
+	}
+	if g.isExcludedPath(r.URL.Path) {
+		return true
+	}
+	// An earlier instance of the chain already handled the language
+	if g.config.SkipIfHandled && g.isHandled(r) {
+		return true
+	}
+	return false
+}
 
-	if config.LanguageStrategy == StrategyQuery && config.LanguageParam == "" {
-		return nil, fmt.Errorf("languageParam is required when LanguageStrategy is 'query'")
+// isExcludedPath reports whether the path is outside the include pattern or matches the exclude pattern, only the
+// other paths are handled.
+func (g *LangRedirect) isExcludedPath(requestPath string) bool {
+	if g.includePath != nil && !g.includePath.MatchString(requestPath) {
+		return true
 	}
+	return g.excludePath != nil && g.excludePath.MatchString(requestPath)
+}
 
-	return &LangRedirect{
-		next:   next,
-		config: config,
-	}, nil
+// handledKey marks the requests handled by an earlier instance of the same chain.
+type handledKey struct{}
+
+// isHandled reports whether an earlier instance of the chain, or a trusted proxy in front, already handled the language.
+func (g *LangRedirect) isHandled(r *http.Request) bool {
+	if r.Context().Value(handledKey{}) != nil {
+		return true
+	}
+	return r.Header.Get(HandledHeader) != "" && len(g.proxies) > 0 && g.isTrustedProxy(remoteIP(r))
 }
 
-// ServeHTTP implements the http.Handler interface.
-func (g *LangRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	languageByHeader := g.getPreferredLanguage(r.Header.Get("Accept-Language"))
+// redirectTarget returns the Location of a redirect to the rewritten request URL.
+func (g *LangRedirect) redirectTarget(r *http.Request) string {
+	target := *r.URL
+	if len(g.config.PreserveQueryParams) > 0 {
+		target.RawQuery = g.preservedQuery(target.RawQuery)
+	}
+	// The marker of an earlier redirect is replaced, not repeated
+	if g.config.RedirectMarkerParam != "" {
+		target.RawQuery = setQueryParam(target.RawQuery, g.config.RedirectMarkerParam, "1")
+	}
+	if g.config.AbsoluteRedirect {
+		target.Scheme, target.Host = g.requestScheme(r), g.requestHost(r)
+	}
+	return target.String()
+}
 
-	if languageByHeader != "" && (languageByHeader != g.config.DefaultLanguage || g.config.DefaultLanguageHandling) {
-		if strategy, err := g.getStrategy(); err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		} else {
-			// Maybe lang already exist
-			languageByRequest := strategy.GetLanguage(r)
-			// Set lang
-			if languageByRequest == "" || languageByRequest != languageByHeader {
-				// Executing
-				strategy.SetLanguage(w, r, languageByHeader)
-				// Stop further execution if a redirect perform
-				if g.config.RedirectAfterHandling {
-					http.Redirect(w, r, r.URL.String(), http.StatusFound)
-					return
-				}
+// preservedQuery keeps the params of the allowlist and the language param in their original order.
+func (g *LangRedirect) preservedQuery(rawQuery string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); err == nil && (name == g.config.LanguageParam || isPreservedParam(name, g.config.PreserveQueryParams)) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// removeQueryParam drops every entry of the param from a raw query, the others keep their order and escaping.
+func removeQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err != nil || unescaped != name {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// setQueryParam replaces the param of a raw query with a single entry at its end, the others keep their order.
+func setQueryParam(rawQuery, name, value string) string {
+	entry := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	if rawQuery = removeQueryParam(rawQuery, name); rawQuery == "" {
+		return entry
+	}
+	return rawQuery + "&" + entry
+}
+
+// isPreservedParam matches the name against the allowlist, a trailing "*" matches any suffix (utm_*).
+func isPreservedParam(name string, allowlist []string) bool {
+	for _, allowed := range allowlist {
+		if strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*")) || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme the client used, as forwarded by a proxy.
+func (g *LangRedirect) requestScheme(r *http.Request) string {
+	// Anything else would end up in the Location as is
+	if proto := asciiLower(firstHeaderValue(r, "X-Forwarded-Proto")); (proto == "http" || proto == "https") && g.trustsForwardedHeaders(r) {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client used, as forwarded by a proxy.
+func (g *LangRedirect) requestHost(r *http.Request) string {
+	if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" && g.trustsForwardedHeaders(r) {
+		return host
+	}
+	return r.Host
+}
+
+// firstHeaderValue returns the first entry of a comma-separated header.
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// isProbe reports whether the request asks for a negotiation preview.
+func (g *LangRedirect) isProbe(r *http.Request) bool {
+	return g.config.NegotiationProbePath != "" && r.Method == http.MethodOptions && r.URL.Path == g.config.NegotiationProbePath
+}
+
+// serveProbe answers a negotiation preview with the detected language and its source.
+func (g *LangRedirect) serveProbe(w http.ResponseWriter, r *http.Request, language, source string) {
+	if origin := g.config.InfoAllowOrigin; origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		// OPTIONS is not a simple method, browsers ask with a preflight before calling the probe from another origin
+		if r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", http.MethodOptions)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
 			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"language": language, "source": source}); err != nil {
+		g.logEvent(logEntry{Action: "error", Error: err.Error()})
+	}
+}
 
-	g.next.ServeHTTP(w, r)
+// defaultPickerTemplate is the language picker page, {links} is replaced by a list item linking each language.
+const defaultPickerTemplate = "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Language</title></head>" +
+	"<body><ul>{links}</ul></body></html>\n"
+
+// canShowPicker reports whether a page request without a language in the URL or cookie may be answered with the
+// language picker.
+func (g *LangRedirect) canShowPicker(r *http.Request, strategy Strategy) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return g.canRedirect(r) && !containsLanguage(g.languages, strategy.GetLanguage(r))
 }
 
-/* Helpers
- * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+// servePicker answers with the PickerTemplate page linking the request URL in every supported language.
+func (g *LangRedirect) servePicker(w http.ResponseWriter, r *http.Request, strategy Strategy) {
+	var links strings.Builder
+	for _, lang := range g.config.Languages {
+		href, lang := html.EscapeString(g.pickerURL(r, strategy, lang)), html.EscapeString(lang)
+		_, _ = fmt.Fprintf(&links, `<li><a href="%s" hreflang="%s" lang="%s">%s</a></li>`, href, lang, lang, lang)
+	}
 
-func (g *LangRedirect) getPreferredLanguage(acceptLanguage string) string {
-	languages := parseAcceptLanguage(acceptLanguage)
-	for _, lang := range languages {
-		for _, supportedLang := range g.config.Languages {
-			if lang == supportedLang {
-				return lang
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = io.WriteString(w, strings.ReplaceAll(g.config.PickerTemplate, "{links}", links.String()))
+	}
+}
+
+// pickerURL returns the request URL in the language, with the cookie strategy as the query switch it honors.
+func (g *LangRedirect) pickerURL(r *http.Request, strategy Strategy, lang string) string {
+	target := *r.URL
+	target.RawQuery = g.withoutMarker(target.RawQuery)
+	if g.config.LanguageStrategy == StrategyCookie {
+		query := target.Query()
+		query.Set(g.config.LanguageParam, lang)
+		target.RawQuery = query.Encode()
+	} else {
+		strategy.SetLanguage(nil, &http.Request{URL: &target}, lang)
+	}
+	return target.String()
+}
+
+// alternateLinks returns Link header values with the absolute URL of the request in every supported language, plus
+// the language-neutral URL as x-default. Only strategies carrying the language in the URL have alternates.
+func (g *LangRedirect) alternateLinks(r *http.Request, strategy Strategy) []string {
+	remover, ok := strategy.(languageRemover)
+	if !ok {
+		return nil
+	}
+
+	alternate := func(hreflang string, set func(*http.Request)) string {
+		target := *r.URL
+		target.RawQuery = g.withoutMarker(target.RawQuery)
+		set(&http.Request{URL: &target})
+		target.Scheme, target.Host = g.requestScheme(r), g.requestHost(r)
+		return fmt.Sprintf(`<%s>; rel="alternate"; hreflang="%s"`, target.String(), hreflang)
+	}
+
+	links := make([]string, 0, len(g.config.Languages)+1)
+	for _, lang := range g.config.Languages {
+		links = append(links, alternate(lang, func(alt *http.Request) { strategy.SetLanguage(nil, alt, lang) }))
+	}
+	return append(links, alternate("x-default", remover.removeLanguage))
+}
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// defaultRedirectBodyTemplate is the redirect body, {lang} is replaced by the target language and {location} by the
+// target URL.
+const defaultRedirectBodyTemplate = "<!DOCTYPE html>\n<html lang=\"{lang}\"><head><meta charset=\"utf-8\">" +
+	"<link rel=\"canonical\" href=\"{location}\"></head><body><a href=\"{location}\">{location}</a></body></html>\n"
+
+// redirect answers with a redirect to the rewritten request URL.
+func (g *LangRedirect) redirect(w http.ResponseWriter, r *http.Request, language, from string, status int) {
+	g.countRedirect(w, r)
+	to := g.redirectTarget(r)
+	if g.config.LogRedirects {
+		g.logEvent(logEntry{Action: "redirect", Lang: language, Strategy: g.config.LanguageStrategy, From: from, To: to})
+	}
+	if !g.config.RedirectBody {
+		http.Redirect(w, r, to, status)
+		return
+	}
+
+	// A link for clients and crawlers not following redirects, in the language of the target
+	w.Header().Set("Location", to)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		body := strings.NewReplacer("{lang}", html.EscapeString(language), "{location}", html.EscapeString(to))
+		_, _ = body.WriteString(w, g.config.RedirectBodyTemplate)
+	}
+}
+
+// canRedirect reports whether the request may be answered with a redirect, otherwise it is only rewritten.
+func (g *LangRedirect) canRedirect(r *http.Request) bool {
+	// Media players break on a redirected partial content request
+	if g.config.SkipRangeRequests && r.Header.Get("Range") != "" {
+		return false
+	}
+	// Speculative loads would follow the redirect for nothing
+	if g.config.SkipPrefetch && isPrefetch(r) {
+		return false
+	}
+	// Deep links are never redirected
+	if g.config.CookieOnly || g.isDetectOnly(r) {
+		return false
+	}
+	// Only the first request of a session is redirected
+	if g.isSessionHandled(r) {
+		return false
+	}
+	// Shared links that must not bounce
+	if g.hasNoRedirectParam(r) {
+		return false
+	}
+	// Loop guard for misconfigured setups
+	if g.config.MaxRedirects > 0 && redirectCount(r) >= g.config.MaxRedirects {
+		return false
+	}
+	return true
+}
+
+// withoutMarker removes the Config.RedirectMarkerParam of an earlier redirect from a raw query, it only describes that
+// request and is no part of the page URL.
+func (g *LangRedirect) withoutMarker(rawQuery string) string {
+	if g.config.RedirectMarkerParam == "" {
+		return rawQuery
+	}
+	return removeQueryParam(rawQuery, g.config.RedirectMarkerParam)
+}
+
+// hasNoRedirectParam reports whether the request carries the no-redirect query flag.
+func (g *LangRedirect) hasNoRedirectParam(r *http.Request) bool {
+	return g.config.NoRedirectParam != "" && r.URL.Query().Has(g.config.NoRedirectParam)
+}
+
+// collapseSlashes replaces runs of slashes in a path with a single slash.
+func collapseSlashes(p string) string {
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// isExplicitSource reports whether the language was chosen by the user or the application rather than negotiated.
+func isExplicitSource(source string) bool {
+	switch source {
+	case StrategyQuery, StrategyPath, SourceForm, SourceOverride, SourceCookie:
+		return true
+	}
+	return false
+}
+
+// sourceToken returns the source reported in the source header, telling a matched default language from a fallback
+// to it when enabled.
+func (g *LangRedirect) sourceToken(language, source string) string {
+	if !g.config.DistinguishDefaultSource || language != g.config.DefaultLanguage {
+		return source
+	}
+	switch source {
+	case SourceHeader:
+		return SourceDefaultMatch
+	case SourceDefault:
+		return SourceDefaultFallback
+	}
+	return source
+}
+
+// isPrefetch reports whether the request is a speculative prefetch or prerender load.
+func isPrefetch(r *http.Request) bool {
+	for _, name := range []string{"Sec-Purpose", "Purpose"} {
+		for _, token := range strings.FieldsFunc(r.Header.Get(name), func(c rune) bool { return c == ',' || c == ';' }) {
+			if token = strings.TrimSpace(token); asciiEqualFold(token, "prefetch") || asciiEqualFold(token, "prerender") {
+				return true
 			}
 		}
 	}
-	return g.config.DefaultLanguage
+	return false
 }
 
-func parseAcceptLanguage(acceptLanguage string) []string {
-	parts := strings.Split(acceptLanguage, ",")
-	languages := make([]string, 0, len(parts))
-	for _, part := range parts {
-		lang := strings.SplitN(part, ";", 2)[0]
-		lang = strings.TrimSpace(lang)
-		languages = append(languages, lang)
+// redirectCount returns the number of language redirects the request has already gone through.
+func redirectCount(r *http.Request) int {
+	count, err := strconv.Atoi(r.Header.Get(RedirectCountHeader))
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// countRedirect increments the redirect counter on the request and announces it on the response.
+func (g *LangRedirect) countRedirect(w http.ResponseWriter, r *http.Request) {
+	count := strconv.Itoa(redirectCount(r) + 1)
+	r.Header.Set(RedirectCountHeader, count)
+	w.Header().Set(RedirectCountHeader, count)
+}
+
+// allowsCookies reports whether persistent cookies may be written in response to the request.
+func (g *LangRedirect) allowsCookies(r *http.Request) bool {
+	return !g.config.RespectDNT || !doNotTrack(r)
+}
+
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1"
+}
+
+func hasCookieValue(r *http.Request, name, value string) bool {
+	cookie, err := r.Cookie(name)
+	return err == nil && cookie.Value == value
+}
+
+// setLanguageCookie writes a persistent language cookie to the response.
+func setLanguageCookie(w http.ResponseWriter, name, language string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    language,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func hasCookie(r *http.Request, name string) bool {
+	_, err := r.Cookie(name)
+	return err == nil
+}
+
+// isAuthenticated reports whether the request carries credentials or the given session cookie.
+func isAuthenticated(r *http.Request, sessionCookieName string) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	if sessionCookieName == "" {
+		return false
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	return err == nil && cookie.Value != ""
+}
+
+// isExcludedExtension reports whether the file extension of the path is one of extensions, with or without the dot.
+func isExcludedExtension(requestPath string, extensions []string) bool {
+	ext := path.Ext(requestPath)
+	if ext == "" {
+		return false
+	}
+	for _, excluded := range extensions {
+		if strings.EqualFold(strings.TrimPrefix(excluded, "."), ext[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade reports whether the request is a WebSocket handshake.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// isDocumentRequest reports whether the request looks like a top-level document navigation.
+func isDocumentRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" || r.Header.Get("Sec-Fetch-Mode") == "cors" {
+		return false
 	}
-	return languages
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest == "document"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func isStrategy(name string) bool {
+	switch name {
+	case StrategyHeader, StrategyPath, StrategyQuery, StrategyCookie:
+		return true
+	}
+	return false
 }
 
 func (g *LangRedirect) getStrategy() (Strategy, error) {
-	switch g.config.LanguageStrategy {
+	return g.newStrategy(g.config.LanguageStrategy)
+}
+
+func (g *LangRedirect) newStrategy(name string) (Strategy, error) {
+	switch name {
 	case StrategyHeader:
 		return &HeaderStrategy{}, nil
 	case StrategyPath:
-		return &PathStrategy{}, nil
+		return &PathStrategy{
+			position:      g.config.PathPosition,
+			languages:     g.languages,
+			trailingSlash: g.config.NormalizeTrailingSlash,
+		}, nil
 	case StrategyQuery:
-		return &QueryStrategy{languageParam: g.config.LanguageParam}, nil
+		return &QueryStrategy{
+			languageParam: g.config.LanguageParam,
+			languages:     g.languages,
+			aliases:       g.config.QueryValueAliases,
+			delimiter:     g.config.QueryValueDelimiter,
+		}, nil
+	case StrategyCookie:
+		return &CookieStrategy{
+			name:       g.config.CookieName,
+			jsonField:  g.config.CookieJSONField,
+			mergeJSON:  g.config.CookieMergeJSON,
+			languages:  g.languages,
+			respectDNT: g.config.RespectDNT,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid LanguageStrategy: %s", name)
+	}
+}
+
+// logEntry is a log event, keyed consistently in both log formats.
+type logEntry struct {
+	TS       string `json:"ts"`
+	Plugin   string `json:"plugin"`
+	Action   string `json:"action"`
+	Lang     string `json:"lang,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Message  string `json:"msg,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// logEvent writes the event as a single-line JSON object or as a text line prefixed by the plugin name.
+func (g *LangRedirect) logEvent(event logEntry) {
+	if g.config.LogFormat == LogFormatJSON {
+		event.TS = time.Now().UTC().Format(time.RFC3339Nano)
+		event.Plugin = g.name
+		line, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		g.logger.Print(string(line))
+		return
+	}
+
+	switch {
+	case event.Error != "":
+		g.logger.Printf("%s: %s", g.name, event.Error)
+	case event.Message != "":
+		g.logger.Printf("%s: %s", g.name, event.Message)
 	default:
-		return nil, fmt.Errorf("invalid LanguageStrategy: %s", g.config.LanguageStrategy)
+		g.logger.Printf("%s: %s lang=%s strategy=%s from=%s to=%s", g.name, event.Action, event.Lang, event.Strategy, event.From, event.To)
 	}
 }
 
 /* Handlers
  * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
 
+// Strategy reads and writes the language of a request. SetLanguage must only touch the language itself, other request
+// headers (e.g. conditional If-None-Match/If-Modified-Since) have to survive the rewrite or redirect.
 type Strategy interface {
 	GetLanguage(r *http.Request) string
 	SetLanguage(w http.ResponseWriter, r *http.Request, language string)
 }
 
+// RawLanguageGetter is implemented by strategies whose stored value may differ from the canonical language code.
+type RawLanguageGetter interface {
+	GetRawLanguage(r *http.Request) string
+}
+
+// languageRemover is implemented by strategies carrying the language in the URL.
+type languageRemover interface {
+	removeLanguage(r *http.Request)
+}
+
+// rawLanguage returns the language exactly as stored in the request.
+func rawLanguage(strategy Strategy, r *http.Request) string {
+	if getter, ok := strategy.(RawLanguageGetter); ok {
+		return getter.GetRawLanguage(r)
+	}
+	return strategy.GetLanguage(r)
+}
+
 type HeaderStrategy struct {
 }
 
 type PathStrategy struct {
+	position      string
+	languages     []string
+	trailingSlash string
 }
 
 type QueryStrategy struct {
 	languageParam string
+	languages     []string
+	aliases       map[string]string
+	delimiter     string
+}
+
+type CookieStrategy struct {
+	name       string
+	jsonField  string
+	mergeJSON  bool
+	languages  []string
+	respectDNT bool
 }
 
 func (h *HeaderStrategy) GetLanguage(r *http.Request) string {
@@ -152,22 +2921,100 @@ func (h *HeaderStrategy) SetLanguage(w http.ResponseWriter, r *http.Request, lan
 }
 
 func (p *PathStrategy) GetLanguage(r *http.Request) string {
-	segments := strings.Split(r.URL.Path, "/")
-	if len(segments) > 1 && len(segments[1]) == 2 {
-		return segments[1]
+	language, _ := findLanguage(p.languages, p.GetRawLanguage(r))
+	return language
+}
+
+func (p *PathStrategy) GetRawLanguage(r *http.Request) string {
+	if segments, index := p.languageSegment(r.URL.Path); index >= 0 {
+		return segments[index]
 	}
 	return ""
 }
 
 func (p *PathStrategy) SetLanguage(w http.ResponseWriter, r *http.Request, language string) {
-	if r.URL.Path == "/" {
+	segments, index := p.languageSegment(r.URL.Path)
+	switch {
+	case index >= 0:
+		// Replace the language already in the path
+		segments[index] = language
+		r.URL.Path = strings.Join(segments, "/")
+	case p.position == PathPositionSuffix:
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/") + "/" + language
+	case r.URL.Path == "/":
 		r.URL.Path = "/" + language
-	} else {
+	default:
 		r.URL.Path = "/" + language + r.URL.Path
 	}
+
+	// Normalize in the same rewrite to avoid a second redirect
+	switch p.trailingSlash {
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path += "/"
+		}
+	case TrailingSlashRemove:
+		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
+	}
+}
+
+// removeLanguage drops the language segment from the path.
+func (p *PathStrategy) removeLanguage(r *http.Request) {
+	segments, index := p.languageSegment(r.URL.Path)
+	if index < 0 {
+		return
+	}
+	r.URL.Path = strings.Join(append(segments[:index], segments[index+1:]...), "/")
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		r.URL.Path = "/" + r.URL.Path
+	}
+}
+
+// languageSegment splits the path and returns the index of the segment holding a configured language, or -1.
+func (p *PathStrategy) languageSegment(path string) ([]string, int) {
+	if p.position == PathPositionSuffix {
+		segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+		if _, ok := findLanguage(p.languages, segments[len(segments)-1]); ok {
+			return segments, len(segments) - 1
+		}
+		return segments, -1
+	}
+
+	segments := strings.Split(path, "/")
+	if len(segments) > 1 {
+		if _, ok := findLanguage(p.languages, segments[1]); ok {
+			return segments, 1
+		}
+	}
+	return segments, -1
 }
 
 func (q *QueryStrategy) GetLanguage(r *http.Request) string {
+	language := q.GetRawLanguage(r)
+	if q.delimiter != "" && strings.Contains(language, q.delimiter) {
+		// A preference list, the first supported entry wins
+		for _, candidate := range strings.Split(language, q.delimiter) {
+			if canonical, ok := q.canonicalLanguage(strings.TrimSpace(candidate)); ok {
+				return canonical
+			}
+		}
+		return language
+	}
+	if canonical, ok := q.canonicalLanguage(language); ok {
+		return canonical
+	}
+	return language
+}
+
+// canonicalLanguage returns the supported language of a query value or alias.
+func (q *QueryStrategy) canonicalLanguage(language string) (string, bool) {
+	if canonical, ok := q.aliases[language]; ok {
+		return canonical, true
+	}
+	return findLanguage(q.languages, language)
+}
+
+func (q *QueryStrategy) GetRawLanguage(r *http.Request) string {
 	query := r.URL.Query()
 	return query.Get(q.languageParam)
 }
@@ -177,3 +3024,109 @@ func (q *QueryStrategy) SetLanguage(w http.ResponseWriter, r *http.Request, lang
 	query.Set(q.languageParam, language)
 	r.URL.RawQuery = query.Encode()
 }
+
+func (c *CookieStrategy) GetLanguage(r *http.Request) string {
+	language := c.GetRawLanguage(r)
+	if canonical, ok := findLanguage(c.languages, language); ok {
+		return canonical
+	}
+	return language
+}
+
+func (c *CookieStrategy) GetRawLanguage(r *http.Request) string {
+	cookie, err := r.Cookie(c.name)
+	if err != nil {
+		return ""
+	}
+	if c.jsonField != "" {
+		return jsonCookieField(cookie.Value, c.jsonField)
+	}
+	return cookie.Value
+}
+
+func (c *CookieStrategy) SetLanguage(w http.ResponseWriter, r *http.Request, language string) {
+	value := c.cookieValue(r, language)
+	if !c.respectDNT || !doNotTrack(r) {
+		setLanguageCookie(w, c.name, value)
+	}
+
+	// The backend sees the new language right away
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != c.name {
+			r.AddCookie(cookie)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: c.name, Value: value})
+}
+
+// cookieValue returns the cookie value carrying the language, a URL-encoded JSON object when a field is configured.
+// With mergeJSON, the field is updated in the JSON object of the current cookie, keeping its other fields.
+func (c *CookieStrategy) cookieValue(r *http.Request, language string) string {
+	if c.jsonField == "" {
+		return language
+	}
+	root := map[string]interface{}{}
+	if c.mergeJSON {
+		if cookie, err := r.Cookie(c.name); err == nil {
+			if object, ok := decodeJSONCookie(cookie.Value).(map[string]interface{}); ok {
+				root = object
+			}
+		}
+	}
+
+	keys := strings.Split(c.jsonField, ".")
+	object := root
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[key] = child
+		}
+		object = child
+	}
+	object[keys[len(keys)-1]] = language
+
+	data, err := json.Marshal(root)
+	if err != nil {
+		return language
+	}
+	return url.QueryEscape(string(data))
+}
+
+// decodeJSONCookie decodes a (URL-encoded) JSON cookie value, nil when it is not JSON. Numbers keep their precision.
+func decodeJSONCookie(value string) interface{} {
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		value = unescaped
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var node interface{}
+	if err := decoder.Decode(&node); err != nil || decoder.More() {
+		return nil
+	}
+	return node
+}
+
+// jsonCookieField returns the string at the dot-separated field path of a (URL-encoded) JSON cookie value, or an
+// empty string when the value is not JSON or the field is missing.
+func jsonCookieField(value, field string) string {
+	node := decodeJSONCookie(value)
+	for _, key := range strings.Split(field, ".") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		node = object[key]
+	}
+	language, _ := node.(string)
+	return language
+}
+
+// removeLanguage drops the language parameter from the query.
+func (q *QueryStrategy) removeLanguage(r *http.Request) {
+	query := r.URL.Query()
+	query.Del(q.languageParam)
+	r.URL.RawQuery = query.Encode()
+}
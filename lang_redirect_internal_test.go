@@ -0,0 +1,44 @@
+package traefik_lang_redirect
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStrategyErrorResponse(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	cfg := CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.ErrorBody = "language handling failed"
+
+	handler, err := NewWithLogger(context.Background(), http.NewServeMux(), cfg, "lang-redirect", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bypass the startup validation
+	handler.(*LangRedirect).config.LanguageStrategy = "bogus"
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+	if body := strings.TrimSpace(recorder.Body.String()); body != "language handling failed" {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if !strings.Contains(buf.String(), "lang-redirect: invalid LanguageStrategy: bogus") {
+		t.Errorf("unexpected log output: %s", buf.String())
+	}
+}
@@ -1 +1,3729 @@
 package traefik_lang_redirect_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	traefik_lang_redirect "github.com/bublicov/traefik-lang-redirect"
+)
+
+func newHandler(t *testing.T, cfg *traefik_lang_redirect.Config, next http.Handler) http.Handler {
+	t.Helper()
+
+	if next == nil {
+		next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	}
+
+	handler, err := traefik_lang_redirect.New(context.Background(), next, cfg, "lang-redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handler
+}
+
+func TestOnlyDocumentRequestsSkipsXHR(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.OnlyDocumentRequests = true
+
+	called := false
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+		if req.URL.Path != "/api/items" {
+			t.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	}))
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+
+	handler.ServeHTTP(recorder, req)
+
+	if !called {
+		t.Error("next handler was not called")
+	}
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+}
+
+func TestOnlyDocumentRequestsHandlesHTML(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.OnlyDocumentRequests = true
+
+	handler := newHandler(t, cfg, nil)
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("unexpected status: %d", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "/de/about" {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
+
+func TestBaseLanguageDefaults(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"de", "en-US", "en-GB"}
+	cfg.DefaultLanguage = "de"
+	cfg.BaseLanguageDefaults = map[string]string{"en": "en-US"}
+
+	var lang string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("Accept-Language")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "en-ZZ,fr;q=0.5")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "en-US" {
+		t.Errorf("unexpected language: %s", lang)
+	}
+}
+
+func TestBaseLanguageDefaultsUnsupportedTarget(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"de", "en-GB"}
+	cfg.DefaultLanguage = "de"
+	cfg.BaseLanguageDefaults = map[string]string{"en": "en-US"}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	if _, err := traefik_lang_redirect.New(context.Background(), next, cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported baseLanguageDefaults target")
+	}
+}
+
+func TestMaxLanguageEntries(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.DefaultLanguageHandling = true
+	cfg.MaxLanguageEntries = 4
+
+	var lang string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("Accept-Language")
+	}))
+
+	// "de" is the fifth entry and must not be considered
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "xa,xb,xc,xd,de")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "en" {
+		t.Errorf("unexpected language: %s", lang)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "xa,xb,xc,de,xe")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "de" {
+		t.Errorf("unexpected language: %s", lang)
+	}
+}
+
+func TestMaxLanguageEntriesOversizedHeader(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+
+	handler := newHandler(t, cfg, nil)
+
+	header := strings.Repeat("xx-junk;q=0.1,", 5000) + "de"
+	allocs := testing.AllocsPerRun(10, func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	if allocs > 100 {
+		t.Errorf("too many allocations for an oversized header: %.0f", allocs)
+	}
+}
+
+func TestPropagateHeader(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.PropagateHeader = "X-Language"
+
+	var lang, path string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+		path = req.URL.Path
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "de" {
+		t.Errorf("unexpected propagated language: %s", lang)
+	}
+	if path != "/de/about" {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	// The default language is propagated too, even though it is not handled
+	req = httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "en")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "en" {
+		t.Errorf("unexpected propagated language: %s", lang)
+	}
+}
+
+func TestDuplicateLanguages(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "en", "de", "en", "de", "fr"}
+	cfg.DefaultLanguage = "en"
+
+	if _, err := traefik_lang_redirect.NewWithLogger(context.Background(), http.NewServeMux(), cfg, "lang-redirect", logger); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "lang-redirect: duplicate entries removed from languages: [en de fr]\n"; buf.String() != expected {
+		t.Errorf("unexpected log output: %q", buf.String())
+	}
+	if len(cfg.Languages) != 6 {
+		t.Errorf("the configured languages were modified: %v", cfg.Languages)
+	}
+}
+
+func TestPathPosition(t *testing.T) {
+	tests := []struct {
+		position string
+		path     string
+		expected string
+	}{
+		{position: traefik_lang_redirect.PathPositionPrefix, path: "/", expected: "/de"},
+		{position: traefik_lang_redirect.PathPositionPrefix, path: "/about", expected: "/de/about"},
+		{position: traefik_lang_redirect.PathPositionPrefix, path: "/de/about", expected: "/de/about"},
+		{position: traefik_lang_redirect.PathPositionSuffix, path: "/", expected: "/de"},
+		{position: traefik_lang_redirect.PathPositionSuffix, path: "/about", expected: "/about/de"},
+		{position: traefik_lang_redirect.PathPositionSuffix, path: "/about/", expected: "/about/de"},
+		{position: traefik_lang_redirect.PathPositionSuffix, path: "/about/de", expected: "/about/de"},
+		{position: traefik_lang_redirect.PathPositionSuffix, path: "/de", expected: "/de"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.PathPosition = test.position
+
+		var path string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			path = req.URL.Path
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Header.Set("Accept-Language", "de")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if path != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.position, test.path, test.expected, path)
+		}
+	}
+}
+
+func TestSkipAuthenticated(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.SkipAuthenticated = true
+	cfg.SessionCookieName = "session"
+
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Authorization", "Bearer token")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("request with Authorization: unexpected status %d", recorder.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("request with session cookie: unexpected status %d", recorder.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(&http.Cookie{Name: "other", Value: "abc"})
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusFound {
+		t.Errorf("anonymous request: unexpected status %d", recorder.Code)
+	}
+}
+
+func TestQueryValueAliases(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.QueryValueAliases = map[string]string{"german": "de", "english": "en"}
+
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/about?lang=german", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("unexpected status: %d", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "/about?lang=de" {
+		t.Errorf("unexpected location: %s", location)
+	}
+
+	// The canonical value is left alone
+	req = httptest.NewRequest(http.MethodGet, "/about?lang=de", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+}
+
+func TestConditionalHeadersSurvive(t *testing.T) {
+	for _, redirect := range []bool{false, true} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.RedirectAfterHandling = redirect
+
+		var forwarded http.Header
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			forwarded = req.Header
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/about", nil)
+		req.Header.Set("Accept-Language", "de")
+		req.Header.Set("If-None-Match", `"abc"`)
+		req.Header.Set("If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !redirect {
+			req.Header = forwarded
+		}
+		if req.Header.Get("If-None-Match") != `"abc"` || req.Header.Get("If-Modified-Since") == "" {
+			t.Errorf("redirect=%v: conditional headers were dropped: %v", redirect, req.Header)
+		}
+	}
+}
+
+func TestExplicitOverridesHeader(t *testing.T) {
+	for _, explicit := range []bool{false, true} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.DefaultLanguageHandling = true
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+		cfg.RedirectAfterHandling = true
+		cfg.ExplicitOverridesHeader = explicit
+		cfg.PropagateHeader = "X-Language"
+
+		var lang string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("X-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/about?lang=de", nil)
+		req.Header.Set("Accept-Language", "en")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if !explicit {
+			if location := recorder.Header().Get("Location"); location != "/about?lang=en" {
+				t.Errorf("unexpected location: %s", location)
+			}
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("unexpected status: %d", recorder.Code)
+		}
+		if lang != "de" {
+			t.Errorf("unexpected propagated language: %s", lang)
+		}
+	}
+}
+
+func TestConfigNotModified(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en;w=2", "de", "de"}
+	cfg.UseFirstLanguageAsDefault = true
+	cfg.ReadStrategy = traefik_lang_redirect.StrategyCookie
+	cfg.WriteStrategy = traefik_lang_redirect.StrategyPath
+	cfg.CookieOnly = true
+	cfg.RedirectAfterHandling = true
+
+	for i := 0; i < 2; i++ {
+		if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err != nil {
+			t.Fatal(err)
+		}
+		if len(cfg.Languages) != 3 || cfg.Languages[0] != "en;w=2" || cfg.DefaultLanguage != "" ||
+			cfg.LanguageStrategy != traefik_lang_redirect.StrategyHeader || !cfg.RedirectAfterHandling {
+			t.Fatalf("the configuration was modified: %+v", cfg)
+		}
+	}
+}
+
+func TestNewWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de", "en"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.LogRedirects = true
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	handler, err := traefik_lang_redirect.NewWithLogger(context.Background(), next, cfg, "embedded", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := "embedded: duplicate entries removed from languages: [en de]\n" +
+		"embedded: redirect lang=de strategy=query from=/ to=/?lang=de\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected log output: %q", buf.String())
+	}
+}
+
+func TestWildcardAcceptLanguage(t *testing.T) {
+	tests := map[string]string{
+		"*":                "fr",
+		"*;q=0.5":          "fr",
+		"xx,*;q=0.1":       "fr",
+		"de;q=0.9,*;q=0.5": "de",
+		" * ":              "fr",
+	}
+
+	for header, expected := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"fr", "en", "de"}
+		cfg.DefaultLanguage = "en"
+
+		var lang string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("Accept-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if lang != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, lang)
+		}
+	}
+}
+
+func TestNormalizeTrailingSlash(t *testing.T) {
+	tests := []struct {
+		mode     string
+		path     string
+		expected string
+	}{
+		{mode: traefik_lang_redirect.TrailingSlashNone, path: "/about/", expected: "/de/about/"},
+		{mode: traefik_lang_redirect.TrailingSlashNone, path: "/about", expected: "/de/about"},
+		{mode: traefik_lang_redirect.TrailingSlashAdd, path: "/about", expected: "/de/about/"},
+		{mode: traefik_lang_redirect.TrailingSlashAdd, path: "/", expected: "/de/"},
+		{mode: traefik_lang_redirect.TrailingSlashRemove, path: "/about/", expected: "/de/about"},
+		{mode: traefik_lang_redirect.TrailingSlashRemove, path: "/", expected: "/de"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.RedirectAfterHandling = true
+		cfg.NormalizeTrailingSlash = test.mode
+
+		handler := newHandler(t, cfg, nil)
+
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Header.Set("Accept-Language", "de")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusFound {
+			t.Errorf("%s %s: unexpected status %d", test.mode, test.path, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.mode, test.path, test.expected, location)
+		}
+	}
+}
+
+func TestFirstVisitOnly(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.DefaultLanguageHandling = true
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.FirstVisitOnly = true
+
+	handler := newHandler(t, cfg, nil)
+
+	// First visit: redirected by Accept-Language and the guard cookie is set
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "/de/about" {
+		t.Errorf("unexpected location: %s", location)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lang_redirect_seen" {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+
+	// Subsequent visit: the user switched to English, the header no longer overrides it
+	req = httptest.NewRequest(http.MethodGet, "/en/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(cookies[0])
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+	if len(recorder.Result().Cookies()) != 0 {
+		t.Errorf("the guard cookie was set again")
+	}
+}
+
+func TestSessionScoped(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.SessionScoped = true
+
+	var path string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+	}))
+
+	// First request of the session: redirected and marked with a session cookie
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "/de/about" {
+		t.Errorf("unexpected location: %s", location)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lang_session" || cookies[0].MaxAge != 0 || !cookies[0].Expires.IsZero() {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+
+	// Within the session: neither redirected nor rewritten
+	req = httptest.NewRequest(http.MethodGet, "/contact", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(cookies[0])
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || path != "/contact" {
+		t.Errorf("unexpected handling within the session: status %d, path %s", recorder.Code, path)
+	}
+	if len(recorder.Result().Cookies()) != 0 {
+		t.Errorf("the session cookie was set again")
+	}
+
+	// New session: handled again
+	req = httptest.NewRequest(http.MethodGet, "/contact", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "/de/contact" {
+		t.Errorf("unexpected location in a new session: %s", location)
+	}
+}
+
+func TestConfigValidationReportsAllErrors(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.LanguageParam = ""
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	_, err := traefik_lang_redirect.New(context.Background(), next, cfg, "lang-redirect")
+	if err == nil {
+		t.Fatal("expected a validation error")
+	}
+
+	for _, message := range []string{"languages are required", "DefaultLanguage is required", "languageParam is required"} {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("missing %q in %q", message, err.Error())
+		}
+	}
+}
+
+func TestInvalidLanguageStrategy(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = "bogus"
+
+	_, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect")
+	if err == nil || !strings.Contains(err.Error(), "invalid LanguageStrategy: bogus") {
+		t.Errorf("expected an error for an unknown LanguageStrategy, got %v", err)
+	}
+}
+
+func TestMatcherMode(t *testing.T) {
+	tests := []struct {
+		header  string
+		builtin string
+		strict  string
+	}{
+		{header: "no", builtin: "en", strict: "nb"},
+		{header: "nb-NO", builtin: "nb", strict: "nb"},
+		{header: "zh", builtin: "en", strict: "zh-Hans"},
+		{header: "zh-CN", builtin: "en", strict: "zh-Hans"},
+		{header: "zh-Hans", builtin: "zh-Hans", strict: "zh-Hans"},
+		{header: "ja", builtin: "en", strict: "en"},
+	}
+
+	for _, mode := range []string{traefik_lang_redirect.MatcherBuiltin, traefik_lang_redirect.MatcherStrict} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "nb", "zh-Hans"}
+		cfg.DefaultLanguage = "en"
+		cfg.DefaultLanguageHandling = true
+		cfg.MatcherMode = mode
+
+		var lang string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("Accept-Language")
+		}))
+
+		for _, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Language", test.header)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			expected := test.builtin
+			if mode == traefik_lang_redirect.MatcherStrict {
+				expected = test.strict
+			}
+			if lang != expected {
+				t.Errorf("%s %q: expected %s, got %s", mode, test.header, expected, lang)
+			}
+		}
+	}
+}
+
+func TestSkipRangeRequests(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.PropagateHeader = "X-Language"
+	cfg.ExcludedExtensions = nil
+
+	called := false
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+		if lang := req.Header.Get("X-Language"); lang != "de" {
+			t.Errorf("unexpected propagated language: %s", lang)
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/video.mp4", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Range", "bytes=0-1023")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+	if !called {
+		t.Error("next handler was not called")
+	}
+}
+
+func TestPathStrategyUnsupportedTwoLetterSegment(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+
+	var path string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+	}))
+
+	tests := map[string]string{
+		"/ui/home":    "/de/ui/home",
+		"/de/ui/home": "/de/ui/home",
+	}
+
+	for requestPath, expected := range tests {
+		req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+		req.Header.Set("Accept-Language", "de")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if path != expected {
+			t.Errorf("%s: expected %s, got %s", requestPath, expected, path)
+		}
+	}
+}
+
+func TestCollapseToBase(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"de", "en-US", "en-GB", "pt-BR"}
+	cfg.DefaultLanguage = "de"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.CollapseToBase = []string{"en"}
+	cfg.PropagateHeader = "X-Language"
+
+	var lang, path string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+		path = req.URL.Path
+	}))
+
+	tests := []struct {
+		header string
+		path   string
+		lang   string
+		result string
+	}{
+		{header: "en-GB", path: "/about", lang: "en", result: "/en/about"},
+		{header: "en-US", path: "/en/about", lang: "en", result: "/en/about"},
+		{header: "pt-BR", path: "/about", lang: "pt-BR", result: "/pt-BR/about"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Header.Set("Accept-Language", test.header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if lang != test.lang || path != test.result {
+			t.Errorf("%s %s: expected %s %s, got %s %s", test.header, test.path, test.lang, test.result, lang, path)
+		}
+	}
+}
+
+func TestNegotiationProbe(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.ExplicitOverridesHeader = true
+	cfg.NegotiationProbePath = "/_lang"
+
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("next handler must not be called for a probe")
+	}))
+
+	tests := []struct {
+		url      string
+		header   string
+		expected string
+	}{
+		{url: "/_lang", header: "de-AT,en;q=0.5", expected: `{"language":"de","source":"header"}`},
+		{url: "/_lang", header: "ja", expected: `{"language":"en","source":"default"}`},
+		{url: "/_lang?lang=de", header: "en", expected: `{"language":"de","source":"query"}`},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodOptions, test.url, nil)
+		req.Header.Set("Accept-Language", test.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", test.url, recorder.Code)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: unexpected content type %s", test.url, contentType)
+		}
+		if body := strings.TrimSpace(recorder.Body.String()); body != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, body)
+		}
+	}
+}
+
+func TestInfoAllowOrigin(t *testing.T) {
+	tests := map[string]struct {
+		origin string
+		vary   string
+	}{
+		"disabled": {},
+		"wildcard": {origin: "*"},
+		"origin":   {origin: "https://app.example.com", vary: "Origin"},
+	}
+
+	for name, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.NegotiationProbePath = "/_lang"
+		cfg.InfoAllowOrigin = test.origin
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodOptions, "/_lang", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != test.origin {
+			t.Errorf("%s: expected allowed origin %q, got %q", name, test.origin, origin)
+		}
+		if vary := recorder.Header().Get("Vary"); vary != test.vary {
+			t.Errorf("%s: expected vary %q, got %q", name, test.vary, vary)
+		}
+	}
+}
+
+func TestInfoAllowOriginPreflight(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.NegotiationProbePath = "/_lang"
+	cfg.InfoAllowOrigin = "https://app.example.com"
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/_lang", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodOptions)
+	req.Header.Set("Access-Control-Request-Headers", "accept-language")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusNoContent || recorder.Body.Len() != 0 {
+		t.Errorf("unexpected preflight response: %d %q", recorder.Code, recorder.Body.String())
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": http.MethodOptions,
+		"Access-Control-Allow-Headers": "accept-language",
+		"Vary":                         "Origin",
+	}
+	for name, value := range expected {
+		if actual := recorder.Header().Get(name); actual != value {
+			t.Errorf("expected %s %q, got %q", name, value, actual)
+		}
+	}
+}
+
+func TestAcceptLanguageQuality(t *testing.T) {
+	tests := map[string]string{
+		"fr;q=0.5,de;q=0.9":        "de",
+		"fr;q=0.5, de-DE; q=0.9":   "de",
+		"fr;q=0.5,de;Q=0.9":        "de",
+		"fr;q=0.5,de ; q = 0.9":    "de",
+		"fr ;Q= 0.5 ,de;q =0.9 ":   "de",
+		"fr;q=bogus,de;q=0.9":      "fr",
+		"fr;level=1;q=0.4,de;q=.6": "de",
+		"de;q=0,fr":                "fr",
+		"de;q=0.9,fr;q=1":          "fr",
+		"fr;q=0,de;q=0.1":          "de",
+		"fr,de;q=2":                "fr",
+		"fr;q=-0.5,de;q=0.1":       "de",
+		"fr;q=NaN,de;q=0.5":        "fr",
+	}
+
+	for header, expected := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "fr", "de"}
+		cfg.DefaultLanguage = "en"
+
+		var lang string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("Accept-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if lang != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, lang)
+		}
+	}
+}
+
+func TestFallbackLanguages(t *testing.T) {
+	tests := map[string]string{
+		"ja":                  "en",
+		"ja,en;q=0":           "fr",
+		"ja,en-US;q=0":        "en",
+		"en;q=0,fr;q=0":       "eo",
+		"de-CH,en;q=0,fr;q=0": "de",
+	}
+
+	for header, expected := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"eo", "en", "fr", "de"}
+		cfg.DefaultLanguage = "eo"
+		cfg.DefaultLanguageHandling = true
+		cfg.FallbackLanguages = []string{"en", "fr"}
+
+		var lang string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("Accept-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if lang != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, lang)
+		}
+	}
+}
+
+func TestCanonicalizeURL(t *testing.T) {
+	tests := []struct {
+		strategy string
+		url      string
+		header   string
+		expected string
+	}{
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/about?lang=EN", header: "en", expected: "/about?lang=en"},
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/about?lang=De", header: "en", expected: "/about?lang=de"},
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/about?lang=en", header: "en", expected: ""},
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/EN/about", header: "en", expected: "/en/about"},
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/DE/about", header: "de", expected: "/de/about"},
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/de/about", header: "de", expected: ""},
+	}
+
+	for _, test := range tests {
+		for _, canonicalize := range []bool{false, true} {
+			cfg := traefik_lang_redirect.CreateConfig()
+			cfg.Languages = []string{"en", "de"}
+			cfg.DefaultLanguage = "en"
+			cfg.LanguageStrategy = test.strategy
+			cfg.CanonicalizeURL = canonicalize
+
+			handler := newHandler(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Set("Accept-Language", test.header)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			expected := test.expected
+			if !canonicalize {
+				expected = ""
+			}
+			if location := recorder.Header().Get("Location"); location != expected {
+				t.Errorf("%s canonicalize=%v: expected %q, got %q", test.url, canonicalize, expected, location)
+			}
+		}
+	}
+}
+
+func TestPathStrategyReplacesLanguage(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de", "fr-CA"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/fr-CA/home", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "/de/home" {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
+
+func TestWebSocketUpgradePassesThrough(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.PropagateHeader = "X-Language"
+
+	called := false
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+		if req.URL.Path != "/ws" || req.Header.Get("X-Language") != "" {
+			t.Errorf("the upgrade request was modified: %s %v", req.URL.Path, req.Header)
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if !called {
+		t.Error("next handler was not called")
+	}
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+}
+
+type memoryStore struct {
+	languages map[string]string
+}
+
+func (m *memoryStore) Get(key string) (string, bool) {
+	lang, ok := m.languages[key]
+	return lang, ok
+}
+
+func (m *memoryStore) Set(key, lang string) {
+	m.languages[key] = lang
+}
+
+func TestPreferenceStore(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de", "fr"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.ExplicitOverridesHeader = true
+	cfg.PreferenceKeyHeader = "X-User-Id"
+	cfg.PropagateHeader = "X-Language"
+
+	store := &memoryStore{languages: map[string]string{"alice": "fr"}}
+
+	var lang string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+	})
+	handler, err := traefik_lang_redirect.NewWithOptions(context.Background(), next, cfg, "lang-redirect",
+		traefik_lang_redirect.WithPreferenceStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stored preference wins over Accept-Language
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("X-User-Id", "alice")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "fr" {
+		t.Errorf("unexpected language for a stored preference: %s", lang)
+	}
+
+	// A negotiated language is not a preference
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("X-User-Id", "bob")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if _, stored := store.languages["bob"]; lang != "de" || stored {
+		t.Errorf("unexpected language for a new user: %s, stored %v", lang, store.languages)
+	}
+
+	for _, acceptLanguage := range []string{"", "ja"} {
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		req.Header.Set("X-User-Id", "bob")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if _, stored := store.languages["bob"]; stored {
+			t.Errorf("%q: the default language was stored: %v", acceptLanguage, store.languages)
+		}
+	}
+
+	// An explicit choice is stored
+	req = httptest.NewRequest(http.MethodGet, "/?lang=de", nil)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("X-User-Id", "bob")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "de" || store.languages["bob"] != "de" {
+		t.Errorf("unexpected language for an explicit choice: %s, stored %s", lang, store.languages["bob"])
+	}
+
+	// Anonymous requests don't touch the store
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(store.languages) != 2 {
+		t.Errorf("unexpected store content: %v", store.languages)
+	}
+}
+
+func TestQueryStrategyEmptyValue(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+
+	var query string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query = req.URL.RawQuery
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/about?lang=&page=2", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "/about?lang=de&page=2" {
+		t.Errorf("unexpected location: %s", location)
+	}
+
+	// Redirected request is stable
+	req = httptest.NewRequest(http.MethodGet, "/about?lang=de&page=2", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", recorder.Code)
+	}
+
+	// The default language is not handled, the empty param is left as is
+	req = httptest.NewRequest(http.MethodGet, "/about?lang=", nil)
+	req.Header.Set("Accept-Language", "en")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || query != "lang=" {
+		t.Errorf("unexpected result: %d %s", recorder.Code, query)
+	}
+}
+
+func TestQueryPersistence(t *testing.T) {
+	for _, mode := range []string{traefik_lang_redirect.QueryPersistenceKeep, traefik_lang_redirect.QueryPersistenceStripAfterCookie} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyCookie
+		cfg.RedirectAfterHandling = true
+		cfg.QueryPersistence = mode
+
+		handler := newHandler(t, cfg, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/about?lang=fr&page=2", nil)
+		req.Header.Set("Accept-Language", "de")
+		req.AddCookie(&http.Cookie{Name: "lang", Value: "de"})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		cookies := recorder.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "lang" || cookies[0].Value != "fr" {
+			t.Errorf("%s: unexpected cookies %v", mode, cookies)
+		}
+
+		location := recorder.Header().Get("Location")
+		switch mode {
+		case traefik_lang_redirect.QueryPersistenceKeep:
+			if recorder.Code != http.StatusOK || location != "" {
+				t.Errorf("%s: unexpected redirect %d %s", mode, recorder.Code, location)
+			}
+		case traefik_lang_redirect.QueryPersistenceStripAfterCookie:
+			if recorder.Code != http.StatusFound || location != "/about?page=2" {
+				t.Errorf("%s: unexpected redirect %d %s", mode, recorder.Code, location)
+			}
+		}
+	}
+}
+
+func TestCookieStrategy(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyCookie
+
+	var cookie string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if c, err := req.Cookie("lang"); err == nil {
+			cookie = c.Value
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if cookie != "de" {
+		t.Errorf("unexpected request cookie: %s", cookie)
+	}
+	if session, err := req.Cookie("session"); err != nil || session.Value != "abc" {
+		t.Errorf("other cookies were dropped: %v", req.Cookies())
+	}
+	if cookies := recorder.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != "de" {
+		t.Errorf("unexpected response cookies: %v", cookies)
+	}
+}
+
+func TestThreeLetterLanguages(t *testing.T) {
+	tests := []struct {
+		strategy string
+		url      string
+		header   string
+		location string
+	}{
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/home", header: "fil", location: "/fil/home"},
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/fil/home", header: "fil", location: ""},
+		{strategy: traefik_lang_redirect.StrategyPath, url: "/fil/home", header: "haw-US", location: "/haw/home"},
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/home", header: "fil", location: "/home?lang=fil"},
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/home?lang=fil", header: "fil", location: ""},
+		{strategy: traefik_lang_redirect.StrategyQuery, url: "/home?lang=haw", header: "fil", location: "/home?lang=fil"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "fil", "haw"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = test.strategy
+		cfg.RedirectAfterHandling = true
+
+		handler := newHandler(t, cfg, nil)
+
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.Header.Set("Accept-Language", test.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%s %s: expected %q, got %q", test.strategy, test.url, test.location, location)
+		}
+	}
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "fil", "haw"}
+	cfg.DefaultLanguage = "en"
+
+	var lang string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("Accept-Language")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "fil-PH,en;q=0.5")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "fil" {
+		t.Errorf("header strategy: unexpected language %s", lang)
+	}
+}
+
+func TestBackendLanguageFormat(t *testing.T) {
+	for _, format := range []string{traefik_lang_redirect.BackendFormatRaw, traefik_lang_redirect.BackendFormatISO6391} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "zh-Hant-TW"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.PropagateHeader = "X-Language"
+		cfg.BackendLanguageFormat = format
+
+		var lang, path string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			lang = req.Header.Get("X-Language")
+			path = req.URL.Path
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/about", nil)
+		req.Header.Set("Accept-Language", "zh-Hant-TW")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		expected := "zh-Hant-TW"
+		if format == traefik_lang_redirect.BackendFormatISO6391 {
+			expected = "zh"
+		}
+		if lang != expected {
+			t.Errorf("%s: expected %s, got %s", format, expected, lang)
+		}
+		if path != "/zh-Hant-TW/about" {
+			t.Errorf("%s: unexpected path %s", format, path)
+		}
+	}
+}
+
+// strategyCase describes a request and what the plugin has to make of it.
+type strategyCase struct {
+	name    string
+	config  func(cfg *traefik_lang_redirect.Config)
+	url     string
+	headers map[string]string
+	cookies map[string]string
+
+	// language is the detected language, result the URL seen by the next handler or the redirect target
+	language  string
+	result    string
+	status    int
+	setCookie string
+}
+
+// runStrategyCases serves each case with a fresh plugin configured for languages en (default), de and fr-CA.
+func runStrategyCases(t *testing.T, cases []strategyCase) {
+	t.Helper()
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := traefik_lang_redirect.CreateConfig()
+			cfg.Languages = []string{"en", "de", "fr-CA"}
+			cfg.DefaultLanguage = "en"
+			cfg.PropagateHeader = "X-Detected-Language"
+			if test.config != nil {
+				test.config(cfg)
+			}
+
+			var language, result string
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				language = req.Header.Get("X-Detected-Language")
+				result = req.URL.String()
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			for name, value := range test.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			status := test.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if recorder.Code != status {
+				t.Errorf("expected status %d, got %d", status, recorder.Code)
+			}
+			if recorder.Code != http.StatusOK {
+				language = req.Header.Get("X-Detected-Language")
+				result = recorder.Header().Get("Location")
+			}
+			if language != test.language {
+				t.Errorf("expected language %q, got %q", test.language, language)
+			}
+			if result != test.result {
+				t.Errorf("expected URL %q, got %q", test.result, result)
+			}
+
+			setCookie := ""
+			if cookies := recorder.Result().Cookies(); len(cookies) > 0 {
+				setCookie = cookies[0].Name + "=" + cookies[0].Value
+			}
+			if setCookie != test.setCookie {
+				t.Errorf("expected Set-Cookie %q, got %q", test.setCookie, setCookie)
+			}
+		})
+	}
+}
+
+func withStrategy(strategy string, redirect bool) func(cfg *traefik_lang_redirect.Config) {
+	return func(cfg *traefik_lang_redirect.Config) {
+		cfg.LanguageStrategy = strategy
+		cfg.RedirectAfterHandling = redirect
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	runStrategyCases(t, []strategyCase{
+		{
+			name:     "header rewrite",
+			config:   withStrategy(traefik_lang_redirect.StrategyHeader, false),
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de-DE,de;q=0.9"},
+			language: "de",
+			result:   "/about",
+		},
+		{
+			name:     "header default language is ignored",
+			config:   withStrategy(traefik_lang_redirect.StrategyHeader, false),
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "ja"},
+			language: "en",
+			result:   "/about",
+		},
+		{
+			name:     "path prefix rewrite",
+			config:   withStrategy(traefik_lang_redirect.StrategyPath, false),
+			url:      "/about?x=1",
+			headers:  map[string]string{"Accept-Language": "fr-CA"},
+			language: "fr-CA",
+			result:   "/fr-CA/about?x=1",
+		},
+		{
+			name:     "path prefix redirect",
+			config:   withStrategy(traefik_lang_redirect.StrategyPath, true),
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/de/about",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "path prefix already set",
+			config:   withStrategy(traefik_lang_redirect.StrategyPath, true),
+			url:      "/de/about",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/de/about",
+		},
+		{
+			name: "path suffix redirect",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+				cfg.PathPosition = traefik_lang_redirect.PathPositionSuffix
+			},
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/about/de",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "query redirect",
+			config:   withStrategy(traefik_lang_redirect.StrategyQuery, true),
+			url:      "/about?page=2",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/about?lang=de&page=2",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "query replaces another language",
+			config:   withStrategy(traefik_lang_redirect.StrategyQuery, false),
+			url:      "/about?lang=fr-CA",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/about?lang=de",
+		},
+		{
+			name:      "cookie set",
+			config:    withStrategy(traefik_lang_redirect.StrategyCookie, false),
+			url:       "/about",
+			headers:   map[string]string{"Accept-Language": "de"},
+			language:  "de",
+			result:    "/about",
+			setCookie: "lang=de",
+		},
+		{
+			name:     "cookie already set",
+			config:   withStrategy(traefik_lang_redirect.StrategyCookie, true),
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de"},
+			cookies:  map[string]string{"lang": "de"},
+			language: "de",
+			result:   "/about",
+		},
+		{
+			name:      "cookie switched by query",
+			config:    withStrategy(traefik_lang_redirect.StrategyCookie, true),
+			url:       "/about?lang=fr-CA",
+			headers:   map[string]string{"Accept-Language": "de"},
+			cookies:   map[string]string{"lang": "de"},
+			language:  "fr-CA",
+			result:    "/about?lang=fr-CA",
+			setCookie: "lang=fr-CA",
+		},
+	})
+}
+
+func TestNoPreferenceTags(t *testing.T) {
+	tests := map[string]string{
+		"und":               "en",
+		"i-default":         "en",
+		"mul,de;q=0.5":      "de",
+		"UND-Latn,fr;q=0.1": "fr",
+	}
+
+	for _, mode := range []string{traefik_lang_redirect.MatcherBuiltin, traefik_lang_redirect.MatcherStrict} {
+		for header, expected := range tests {
+			cfg := traefik_lang_redirect.CreateConfig()
+			// "i" and "und" would match literally or by base truncation
+			cfg.Languages = []string{"en", "de", "fr", "i", "und", "mul"}
+			cfg.DefaultLanguage = "en"
+			cfg.DefaultLanguageHandling = true
+			cfg.MatcherMode = mode
+
+			var lang string
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				lang = req.Header.Get("Accept-Language")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Language", header)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if lang != expected {
+				t.Errorf("%s %q: expected %s, got %s", mode, header, expected, lang)
+			}
+		}
+	}
+}
+
+func TestAbsoluteRedirect(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.AbsoluteRedirect = true
+
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/about?x=1", nil)
+	req.Host = "internal:8080"
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "http://internal:8080/de/about?x=1" {
+		t.Errorf("unexpected location: %s", location)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "www.example.com, proxy.local")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if location := recorder.Header().Get("Location"); location != "https://www.example.com/de/about" {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.AbsoluteRedirect = true
+	cfg.CountryHeader = "CF-IPCountry"
+	cfg.CountryLanguageMap = map[string]string{"AT": "de"}
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.10"}
+	resolver := &countingResolver{countries: map[string]string{"198.51.100.7": "AT"}}
+	handler, err := traefik_lang_redirect.NewWithOptions(context.Background(), http.NewServeMux(), cfg, "lang-redirect", traefik_lang_redirect.WithCountryResolver(resolver))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "www.example.com", "CF-IPCountry": "AT"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		location   string
+	}{
+		{name: "trusted range", remoteAddr: "10.1.2.3:4567", headers: forwarded, location: "https://www.example.com/de/about"},
+		{name: "trusted address", remoteAddr: "192.0.2.10:4567", headers: forwarded, location: "https://www.example.com/de/about"},
+		{name: "untrusted", remoteAddr: "203.0.113.5:4567", headers: forwarded, location: ""},
+		{name: "invalid forwarded scheme", remoteAddr: "10.1.2.3:4567", headers: map[string]string{"X-Forwarded-Proto": "javascript", "CF-IPCountry": "AT"}, location: "http://example.com/de/about"},
+		{name: "uppercase forwarded scheme", remoteAddr: "10.1.2.3:4567", headers: map[string]string{"X-Forwarded-Proto": "HTTPS", "CF-IPCountry": "AT"}, location: "https://example.com/de/about"},
+		{name: "trusted forwarded client", remoteAddr: "10.1.2.3:4567", headers: map[string]string{"X-Forwarded-For": "198.51.100.7, 10.9.9.9"}, location: "http://example.com/de/about"},
+		{name: "untrusted forwarded client", remoteAddr: "203.0.113.5:4567", headers: map[string]string{"X-Forwarded-For": "198.51.100.7"}, location: ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/about", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("Accept-Language", "ja")
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: expected location %q, got %q", test.name, test.location, location)
+		}
+	}
+
+	cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+
+	for _, proxies := range [][]string{{}, {"10.0.0.0/8"}} {
+		var buf bytes.Buffer
+		cfg.TrustedProxies = proxies
+		if _, err := traefik_lang_redirect.NewWithLogger(context.Background(), http.NewServeMux(), cfg, "lang-redirect", log.New(&buf, "", 0)); err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(buf.String(), "trustedProxies"); warned != (len(proxies) == 0) {
+			t.Errorf("%v: expected a startup warning: %t, got %q", proxies, len(proxies) == 0, buf.String())
+		}
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.MaxRedirects = 2
+
+	handler := newHandler(t, cfg, nil)
+
+	// A misbehaving setup keeps dropping the language, so every request would be redirected again
+	count := ""
+	for i := 1; i <= 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/about", nil)
+		req.Header.Set("Accept-Language", "de")
+		if count != "" {
+			req.Header.Set(traefik_lang_redirect.RedirectCountHeader, count)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if i <= cfg.MaxRedirects {
+			if recorder.Code != http.StatusFound {
+				t.Fatalf("request %d: unexpected status %d", i, recorder.Code)
+			}
+			count = recorder.Header().Get(traefik_lang_redirect.RedirectCountHeader)
+			if count != strconv.Itoa(i) {
+				t.Errorf("request %d: unexpected count %s", i, count)
+			}
+			continue
+		}
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("request %d: expected a pass through, got %d", i, recorder.Code)
+		}
+	}
+}
+
+func TestPathQueryReconcile(t *testing.T) {
+	withReconcile := func(strategy, policy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			cfg.LanguageStrategy = strategy
+			cfg.PathQueryReconcile = policy
+		}
+	}
+	headers := map[string]string{"Accept-Language": "ja"}
+
+	runStrategyCases(t, []strategyCase{
+		{
+			name:     "no reconciliation",
+			config:   withReconcile(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.ReconcileNone),
+			url:      "/de/page?lang=fr-CA",
+			headers:  headers,
+			language: "en",
+			result:   "/de/page?lang=fr-CA",
+		},
+		{
+			name:     "path wins",
+			config:   withReconcile(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.ReconcilePathWins),
+			url:      "/de/page?lang=fr-CA",
+			headers:  headers,
+			language: "en",
+			result:   "/de/page?lang=de",
+		},
+		{
+			name:     "query wins",
+			config:   withReconcile(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.ReconcileQueryWins),
+			url:      "/de/page?lang=fr-CA",
+			headers:  headers,
+			language: "en",
+			result:   "/fr-CA/page?lang=fr-CA",
+		},
+		{
+			name:     "redirect to the path representation",
+			config:   withReconcile(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.ReconcileRedirect),
+			url:      "/de/page?lang=fr-CA&x=1",
+			headers:  headers,
+			language: "en",
+			result:   "/de/page?x=1",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "redirect to the query representation",
+			config:   withReconcile(traefik_lang_redirect.StrategyQuery, traefik_lang_redirect.ReconcileRedirect),
+			url:      "/de/page?lang=fr-CA",
+			headers:  headers,
+			language: "en",
+			result:   "/page?lang=fr-CA",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "consistent URL is left alone",
+			config:   withReconcile(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.ReconcileRedirect),
+			url:      "/de/page?lang=de",
+			headers:  headers,
+			language: "en",
+			result:   "/de/page?lang=de",
+		},
+	})
+}
+
+func TestRememberPathLanguage(t *testing.T) {
+	remember := func(cfg *traefik_lang_redirect.Config) {
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.RedirectAfterHandling = true
+		cfg.RememberPathLanguage = true
+	}
+	headers := map[string]string{"Accept-Language": "fr-CA"}
+
+	runStrategyCases(t, []strategyCase{
+		{
+			name:      "path language is remembered",
+			config:    remember,
+			url:       "/de/products",
+			headers:   map[string]string{"Accept-Language": "en"},
+			language:  "en",
+			result:    "/de/products",
+			setCookie: "lang=de",
+		},
+		{
+			name:     "root uses the remembered language",
+			config:   remember,
+			url:      "/",
+			headers:  headers,
+			cookies:  map[string]string{"lang": "de"},
+			language: "de",
+			result:   "/de",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "without a remembered language the header is used",
+			config:   remember,
+			url:      "/",
+			headers:  headers,
+			language: "fr-CA",
+			result:   "/fr-CA",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "disabled",
+			config:   withStrategy(traefik_lang_redirect.StrategyPath, true),
+			url:      "/",
+			headers:  headers,
+			cookies:  map[string]string{"lang": "de"},
+			language: "fr-CA",
+			result:   "/fr-CA",
+			status:   http.StatusFound,
+		},
+	})
+}
+
+func TestScriptSubtagMatching(t *testing.T) {
+	chinese := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "zh-Hans", "zh-Hant"}
+		cfg.LanguageAliases = map[string]string{"zh-TW": "zh-Hant", "zh-CN": "zh-Hans"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "lowercase script", config: chinese, url: "/", headers: map[string]string{"Accept-Language": "zh-hans"}, language: "zh-Hans", result: "/"},
+		{name: "uppercase script", config: chinese, url: "/", headers: map[string]string{"Accept-Language": "ZH-HANS"}, language: "zh-Hans", result: "/"},
+		{name: "traditional script", config: chinese, url: "/", headers: map[string]string{"Accept-Language": "zh-Hant"}, language: "zh-Hant", result: "/"},
+		{name: "alias on the normalized tag", config: chinese, url: "/", headers: map[string]string{"Accept-Language": "ZH-tw"}, language: "zh-Hant", result: "/"},
+		{name: "alias with quality", config: chinese, url: "/", headers: map[string]string{"Accept-Language": "fr, zh-cn;q=0.8"}, language: "zh-Hans", result: "/"},
+	})
+}
+
+func TestLanguageAliasesValidation(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageAliases = map[string]string{"zh-TW": "zh-Hant"}
+
+	_, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect")
+	if err == nil || !strings.Contains(err.Error(), "languageAliases") {
+		t.Errorf("expected a languageAliases error, got %v", err)
+	}
+}
+
+func TestExcludedExtensions(t *testing.T) {
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "asset passes through", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/assets/app.js", headers: headers, result: "/assets/app.js"},
+		{name: "extension case", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/logo.PNG", headers: headers, result: "/logo.PNG"},
+		{name: "page is handled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+		{
+			name: "overridden list",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+				cfg.ExcludedExtensions = []string{"pdf"}
+			},
+			url:      "/assets/app.js",
+			headers:  headers,
+			language: "de",
+			result:   "/de/assets/app.js",
+			status:   http.StatusFound,
+		},
+	})
+}
+
+func TestLogFormat(t *testing.T) {
+	for _, format := range []string{traefik_lang_redirect.LogFormatText, traefik_lang_redirect.LogFormatJSON} {
+		var buf bytes.Buffer
+		logger := log.New(&buf, "", 0)
+
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.RedirectAfterHandling = true
+		cfg.LogFormat = format
+		cfg.LogRedirects = true
+
+		handler, err := traefik_lang_redirect.NewWithLogger(context.Background(), http.NewServeMux(), cfg, "lang-redirect", logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/about", nil)
+		req.Header.Set("Accept-Language", "de")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if format == traefik_lang_redirect.LogFormatText {
+			expected := "lang-redirect: redirect lang=de strategy=path from=/about to=/de/about\n"
+			if buf.String() != expected {
+				t.Errorf("unexpected text log: %q", buf.String())
+			}
+			continue
+		}
+
+		if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+			t.Fatalf("expected a single JSON line, got %q", buf.String())
+		}
+		var entry map[string]string
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON log %q: %v", buf.String(), err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry["ts"]); err != nil {
+			t.Errorf("unexpected ts: %q", entry["ts"])
+		}
+		delete(entry, "ts")
+		expected := map[string]string{
+			"plugin":   "lang-redirect",
+			"action":   "redirect",
+			"lang":     "de",
+			"strategy": "path",
+			"from":     "/about",
+			"to":       "/de/about",
+		}
+		if len(entry) != len(expected) {
+			t.Errorf("unexpected JSON fields: %v", entry)
+		}
+		for key, value := range expected {
+			if entry[key] != value {
+				t.Errorf("%s: expected %q, got %q", key, value, entry[key])
+			}
+		}
+	}
+}
+
+func TestCurrentLanguageHeader(t *testing.T) {
+	current := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.CurrentLanguageHeader = "X-Current-Language"
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{
+			name:     "header suppresses the redirect",
+			config:   current,
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de", "X-Current-Language": "DE"},
+			language: "de",
+			result:   "/about",
+		},
+		{
+			name:     "other language is handled",
+			config:   current,
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de", "X-Current-Language": "en"},
+			language: "de",
+			result:   "/de/about",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "missing header is handled",
+			config:   current,
+			url:      "/about",
+			headers:  map[string]string{"Accept-Language": "de"},
+			language: "de",
+			result:   "/de/about",
+			status:   http.StatusFound,
+		},
+	})
+}
+
+func TestPathLanguageMap(t *testing.T) {
+	mapped := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, false)(cfg)
+		cfg.PathLanguageMap = map[string]string{"de": "de-DE"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "mapped language", config: mapped, url: "/about", headers: map[string]string{"Accept-Language": "de-DE"}, language: "de-DE", result: "/de/about"},
+		{name: "language in the path", config: mapped, url: "/de/about", headers: map[string]string{"Accept-Language": "de"}, language: "de-DE", result: "/de/about"},
+		{name: "unmapped language", config: mapped, url: "/about", headers: map[string]string{"Accept-Language": "fr-CA"}, language: "fr-CA", result: "/fr-CA/about"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en"}
+	cfg.DefaultLanguage = "en"
+	cfg.PathLanguageMap = map[string]string{"de": "de-DE"}
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported pathLanguageMap key")
+	}
+}
+
+func manyLanguages(n int) []string {
+	languages := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		languages = append(languages, string(rune('a'+i/26))+string(rune('a'+i%26))+"-ZZ")
+	}
+	return languages
+}
+
+func TestManyLanguages(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = manyLanguages(50)
+	cfg.DefaultLanguage = cfg.Languages[0]
+	cfg.PropagateHeader = "X-Language"
+
+	var lang string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+	}))
+
+	for _, expected := range cfg.Languages {
+		for _, header := range []string{expected, strings.ToLower(expected), "xx, " + strings.ToUpper(expected) + ";q=0.9"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Language", header)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if lang != expected {
+				t.Errorf("%q: expected %s, got %s", header, expected, lang)
+			}
+		}
+	}
+}
+
+func BenchmarkManyLanguages(b *testing.B) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = manyLanguages(50)
+	cfg.DefaultLanguage = cfg.Languages[0]
+
+	handler, err := traefik_lang_redirect.New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "lang-redirect")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	header := "xx-YY, xy;q=0.9, " + cfg.Languages[49] + ";q=0.8"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// The header strategy rewrites the header to the detected language
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(recorder, req)
+	}
+}
+
+func TestRedundantAcceptLanguage(t *testing.T) {
+	regional := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.BaseLanguageDefaults = map[string]string{"fr": "fr-CA"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "redundant regions", config: regional, url: "/", headers: map[string]string{"Accept-Language": "pt-BR,pt-PT,pt;q=0.9,de;q=0.8"}, language: "de", result: "/"},
+		{name: "base match of the first region", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en-US,en-GB,en;q=0.9,de;q=0.8"}, language: "en", result: "/"},
+		{name: "later exact match", config: regional, url: "/", headers: map[string]string{"Accept-Language": "de-AT;q=0.9,fr-BE;q=0.8,fr-CA;q=0.8"}, language: "de", result: "/"},
+		{name: "exact match after failed base", config: regional, url: "/", headers: map[string]string{"Accept-Language": "es-MX,es-ES;q=0.9,fr-CA;q=0.8"}, language: "fr-CA", result: "/"},
+		{name: "bare base after failed region", config: regional, url: "/", headers: map[string]string{"Accept-Language": "fr,fr-BE;q=0.8"}, language: "fr-CA", result: "/"},
+		{name: "duplicate keeps the highest quality", config: regional, url: "/", headers: map[string]string{"Accept-Language": "de;q=0,de;q=0.5,xx"}, language: "de", result: "/"},
+	})
+}
+
+func BenchmarkRedundantAcceptLanguage(b *testing.B) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = manyLanguages(50)
+	cfg.DefaultLanguage = cfg.Languages[0]
+
+	handler, err := traefik_lang_redirect.New(context.Background(), http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg, "lang-redirect")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	header := "xx-AA, xx-BB, xx-CC, xx-DD;q=0.9, xx;q=0.9, xx-AA;q=0.8, " + cfg.Languages[49] + ";q=0.8"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req.Header.Set("Accept-Language", header)
+		handler.ServeHTTP(recorder, req)
+	}
+}
+
+func TestRespectDNT(t *testing.T) {
+	dnt := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyCookie, true)(cfg)
+		cfg.RespectDNT = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "no cookie with DNT", config: dnt, url: "/about", headers: map[string]string{"Accept-Language": "de", "DNT": "1"}, language: "de", result: "/about"},
+		{name: "cookie without DNT", config: dnt, url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/about", setCookie: "lang=de"},
+		{name: "DNT ignored when disabled", config: withStrategy(traefik_lang_redirect.StrategyCookie, true), url: "/about", headers: map[string]string{"Accept-Language": "de", "DNT": "1"}, language: "de", result: "/about", setCookie: "lang=de"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyCookie
+	cfg.RespectDNT = true
+
+	var cookie string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if c, err := req.Cookie("lang"); err == nil {
+			cookie = c.Value
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("DNT", "1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if header := recorder.Header().Get("Set-Cookie"); header != "" {
+		t.Errorf("unexpected Set-Cookie: %s", header)
+	}
+	if cookie != "de" {
+		t.Errorf("expected the backend to see de, got %q", cookie)
+	}
+}
+
+func TestDetectOnlyPaths(t *testing.T) {
+	detectOnly := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.DetectOnlyPaths = []string{"/share/"}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "detect-only path", config: detectOnly, url: "/share/abc?ref=mail", headers: headers, language: "de", result: "/share/abc?ref=mail"},
+		{name: "other path", config: detectOnly, url: "/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+	})
+}
+
+func TestNormalizeUnderscores(t *testing.T) {
+	regional := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en-US", "de"}
+		cfg.DefaultLanguage = "de"
+	}
+	disabled := func(cfg *traefik_lang_redirect.Config) {
+		cfg.NormalizeUnderscores = false
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "regional tag", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en_US"}, language: "en-US", result: "/"},
+		{name: "base tag", url: "/", headers: map[string]string{"Accept-Language": "de_AT"}, language: "de", result: "/"},
+		{name: "disabled", config: disabled, url: "/", headers: map[string]string{"Accept-Language": "de_AT"}, language: "en", result: "/"},
+	})
+}
+
+func TestASCIICaseFolding(t *testing.T) {
+	turkish := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "tr", "it", "sk"}
+		cfg.DefaultLanguage = "en"
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "uppercase code", config: turkish, url: "/", headers: map[string]string{"Accept-Language": "TR"}, language: "tr", result: "/"},
+		{name: "uppercase regional code", config: turkish, url: "/", headers: map[string]string{"Accept-Language": "TR-tr"}, language: "tr", result: "/"},
+		{name: "dotted capital I", config: turkish, url: "/", headers: map[string]string{"Accept-Language": "\u0130T"}, language: "en", result: "/"},
+		{name: "long s", config: turkish, url: "/", headers: map[string]string{"Accept-Language": "\u017Fk"}, language: "en", result: "/"},
+		{name: "uppercase path", config: func(cfg *traefik_lang_redirect.Config) {
+			turkish(cfg)
+			withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+			cfg.CanonicalizeURL = true
+		}, url: "/TR/about", headers: map[string]string{"Accept-Language": "tr"}, language: "tr", result: "/tr/about", status: http.StatusFound},
+	})
+}
+
+func TestRedirectStatusCodes(t *testing.T) {
+	statuses := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.RedirectStatusCode = http.StatusTemporaryRedirect
+		cfg.CanonicalStatusCode = http.StatusMovedPermanently
+		cfg.CanonicalizeURL = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "language switch", config: statuses, url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about", status: http.StatusTemporaryRedirect},
+		{name: "canonicalization", config: statuses, url: "/DE/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about", status: http.StatusMovedPermanently},
+		{name: "defaults", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about", status: http.StatusFound},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en"}
+	cfg.DefaultLanguage = "en"
+	cfg.RedirectStatusCode = http.StatusOK
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for a non-redirect status")
+	}
+}
+
+func TestPreserveQueryParams(t *testing.T) {
+	preserve := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.PreserveQueryParams = []string{"utm_*", "page"}
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{
+			name:     "path strategy",
+			config:   preserve(traefik_lang_redirect.StrategyPath),
+			url:      "/about?debug=1&utm_source=mail&page=2",
+			headers:  headers,
+			language: "de",
+			result:   "/de/about?utm_source=mail&page=2",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "query strategy keeps the language param",
+			config:   preserve(traefik_lang_redirect.StrategyQuery),
+			url:      "/about?debug=1&utm_source=mail",
+			headers:  headers,
+			language: "de",
+			result:   "/about?lang=de&utm_source=mail",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "everything is kept by default",
+			config:   withStrategy(traefik_lang_redirect.StrategyPath, true),
+			url:      "/about?debug=1&utm_source=mail",
+			headers:  headers,
+			language: "de",
+			result:   "/de/about?debug=1&utm_source=mail",
+			status:   http.StatusFound,
+		},
+	})
+}
+
+func TestSignedOverrideCookie(t *testing.T) {
+	const secret = "s3cret"
+	override := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.OverrideSecret = secret
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+	signed := traefik_lang_redirect.SignOverride(secret, "fr-CA")
+	tampered := "de" + signed[strings.Index(signed, "."):]
+
+	runStrategyCases(t, []strategyCase{
+		{name: "valid signature", config: override, url: "/about", headers: headers, cookies: map[string]string{"lang_override": signed}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "tampered language", config: override, url: "/about", headers: headers, cookies: map[string]string{"lang_override": tampered}, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "other secret", config: override, url: "/about", headers: headers, cookies: map[string]string{"lang_override": traefik_lang_redirect.SignOverride("other", "fr-CA")}, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "unsigned", config: override, url: "/about", headers: headers, cookies: map[string]string{"lang_override": "fr-CA"}, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "disabled without a secret", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/about", headers: headers, cookies: map[string]string{"lang_override": signed}, language: "de", result: "/de/about", status: http.StatusFound},
+	})
+}
+
+func TestPreferConfigOrder(t *testing.T) {
+	configOrder := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "de", "fr"}
+		cfg.PreferConfigOrder = true
+	}
+	headerOrder := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "de", "fr"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "tie resolved by config order", config: configOrder, url: "/", headers: map[string]string{"Accept-Language": "fr;q=0.8,de;q=0.8"}, language: "de", result: "/"},
+		{name: "tie with base matches", config: configOrder, url: "/", headers: map[string]string{"Accept-Language": "fr-BE;q=0.8, de-AT;q=0.8"}, language: "de", result: "/"},
+		{name: "higher quality still wins", config: configOrder, url: "/", headers: map[string]string{"Accept-Language": "fr;q=0.9,de;q=0.8"}, language: "fr", result: "/"},
+		{name: "unsupported entries do not tie", config: configOrder, url: "/", headers: map[string]string{"Accept-Language": "xx;q=0.8,fr;q=0.8"}, language: "fr", result: "/"},
+		{name: "header order by default", config: headerOrder, url: "/", headers: map[string]string{"Accept-Language": "fr;q=0.8,de;q=0.8"}, language: "fr", result: "/"},
+	})
+}
+
+func TestPreferExactRegion(t *testing.T) {
+	regional := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"de-DE", "en", "fr-CA"}
+		cfg.PreferExactRegion = true
+	}
+	disabled := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"de-DE", "en", "fr-CA"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "regional within window", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en,de-DE;q=0.9"}, language: "de-DE", result: "/"},
+		{name: "regional outside window", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en,de-DE;q=0.8"}, language: "en", result: "/"},
+		{name: "over base match", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en-US,de-DE;q=0.95"}, language: "de-DE", result: "/"},
+		{name: "exact regional first", config: regional, url: "/", headers: map[string]string{"Accept-Language": "fr-CA,de-DE;q=0.95"}, language: "fr-CA", result: "/"},
+		{name: "higher regional wins", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en,fr-CA;q=0.95,de-DE;q=0.9"}, language: "fr-CA", result: "/"},
+		{name: "bare tags are not regional", config: regional, url: "/", headers: map[string]string{"Accept-Language": "en,de;q=0.9"}, language: "en", result: "/"},
+		{name: "disabled", config: disabled, url: "/", headers: map[string]string{"Accept-Language": "en,de-DE;q=0.9"}, language: "en", result: "/"},
+	})
+}
+
+func TestForceLanguage(t *testing.T) {
+	forced := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.ForceLanguage = "fr-CA"
+		cfg.ExplicitOverridesHeader = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "header", config: forced, url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "no header", config: forced, url: "/about", language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "explicit path language", config: forced, url: "/de/about", headers: map[string]string{"Accept-Language": "de"}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "already forced", config: forced, url: "/fr-CA/about", headers: map[string]string{"Accept-Language": "de"}, language: "fr-CA", result: "/fr-CA/about"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en"}
+	cfg.DefaultLanguage = "en"
+	cfg.ForceLanguage = "de"
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported forceLanguage")
+	}
+}
+
+func TestUseRefererLanguage(t *testing.T) {
+	referer := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyQuery, true)(cfg)
+		cfg.UseRefererLanguage = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{
+			name:     "referer provides the language",
+			config:   referer,
+			url:      "/download",
+			headers:  map[string]string{"Accept-Language": "xx", "Referer": "http://example.com/de/products"},
+			language: "de",
+			result:   "/download?lang=de",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "accept-language ranks higher",
+			config:   referer,
+			url:      "/download",
+			headers:  map[string]string{"Accept-Language": "fr-CA", "Referer": "http://example.com/de/products"},
+			language: "fr-CA",
+			result:   "/download?lang=fr-CA",
+			status:   http.StatusFound,
+		},
+		{
+			name:     "foreign referer is ignored",
+			config:   referer,
+			url:      "/download",
+			headers:  map[string]string{"Referer": "http://other.example/de/products"},
+			language: "en",
+			result:   "/download",
+		},
+		{
+			name:     "disabled",
+			config:   withStrategy(traefik_lang_redirect.StrategyQuery, true),
+			url:      "/download",
+			headers:  map[string]string{"Referer": "http://example.com/de/products"},
+			language: "en",
+			result:   "/download",
+		},
+	})
+}
+
+func TestStripDefaultQueryParam(t *testing.T) {
+	strip := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyQuery, true)(cfg)
+		cfg.StripDefaultQueryParam = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "default param is stripped", config: strip, url: "/about?lang=en&page=2", headers: map[string]string{"Accept-Language": "en"}, language: "en", result: "/about?page=2", status: http.StatusFound},
+		{name: "other param is kept", config: strip, url: "/about?lang=de", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/about?lang=de"},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyQuery, true), url: "/about?lang=en", headers: map[string]string{"Accept-Language": "en"}, language: "en", result: "/about?lang=en"},
+	})
+}
+
+func TestWeightedLanguages(t *testing.T) {
+	weighted := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "de;w=2", "fr;w=0.5"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "tie resolved by weight", config: weighted, url: "/", headers: map[string]string{"Accept-Language": "fr;q=0.8,de;q=0.8"}, language: "de", result: "/"},
+		{name: "tie with the default weight", config: weighted, url: "/", headers: map[string]string{"Accept-Language": "fr, en"}, language: "en", result: "/"},
+		{name: "wildcard", config: weighted, url: "/", headers: map[string]string{"Accept-Language": "*"}, language: "de", result: "/"},
+		{name: "client quality wins", config: weighted, url: "/", headers: map[string]string{"Accept-Language": "fr;q=0.9,de;q=0.8"}, language: "fr", result: "/"},
+		{name: "weights are stripped", config: weighted, url: "/", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/"},
+	})
+
+	for _, languages := range [][]string{{"en", "de;w=0"}, {"en", "de;w=x"}, {"en", "de;q=2"}} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = languages
+		cfg.DefaultLanguage = "en"
+		_, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect")
+		if err == nil || !strings.Contains(err.Error(), "invalid weight") {
+			t.Errorf("%v: expected an invalid weight error, got %v", languages, err)
+		}
+	}
+}
+
+func TestExplicitPathOverridesCookie(t *testing.T) {
+	explicit := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.ExplicitPathOverridesCookie = true
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+	cookies := map[string]string{"lang": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "path language wins", config: explicit(traefik_lang_redirect.StrategyPath), url: "/en/page", headers: headers, cookies: cookies, language: "en", result: "/en/page"},
+		{name: "query language wins", config: explicit(traefik_lang_redirect.StrategyQuery), url: "/page?lang=fr-CA", headers: headers, cookies: cookies, language: "fr-CA", result: "/page?lang=fr-CA"},
+		{name: "no URL language", config: explicit(traefik_lang_redirect.StrategyPath), url: "/page", headers: headers, cookies: cookies, language: "de", result: "/de/page", status: http.StatusFound},
+		{name: "no cookie", config: explicit(traefik_lang_redirect.StrategyPath), url: "/en/page", headers: headers, language: "de", result: "/de/page", status: http.StatusFound},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/en/page", headers: headers, cookies: cookies, language: "de", result: "/de/page", status: http.StatusFound},
+	})
+}
+
+func TestUseClientHints(t *testing.T) {
+	hints := func(cfg *traefik_lang_redirect.Config) {
+		cfg.UseClientHints = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "hint ahead of the header", config: hints, url: "/", headers: map[string]string{"Accept-Language": "fr-CA", "Sec-CH-Lang": `"de", "en"`}, language: "de", result: "/"},
+		{name: "hint without header", config: hints, url: "/", headers: map[string]string{"Sec-CH-Lang": `"fr-CA"`}, language: "fr-CA", result: "/"},
+		{name: "unsupported hint falls back to the header", config: hints, url: "/", headers: map[string]string{"Accept-Language": "de", "Sec-CH-Lang": `"xx"`}, language: "de", result: "/"},
+		{name: "hint is equal to a full quality entry", config: hints, url: "/", headers: map[string]string{"Accept-Language": "de;q=0.9", "Sec-CH-Lang": `"fr-CA"`}, language: "fr-CA", result: "/"},
+		{name: "disabled", url: "/", headers: map[string]string{"Accept-Language": "fr-CA", "Sec-CH-Lang": `"de"`}, language: "fr-CA", result: "/"},
+	})
+}
+
+func TestEmitAlternateLinks(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.EmitAlternateLinks = true
+
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/de/products?page=2", nil)
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	expected := []string{
+		`<https://example.com/en/products?page=2>; rel="alternate"; hreflang="en"`,
+		`<https://example.com/de/products?page=2>; rel="alternate"; hreflang="de"`,
+		`<https://example.com/products?page=2>; rel="alternate"; hreflang="x-default"`,
+	}
+	links := recorder.Header().Values("Link")
+	if strings.Join(links, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected Link headers:\n%s", strings.Join(links, "\n"))
+	}
+
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyHeader
+	handler = newHandler(t, cfg, nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/products", nil))
+	if links := recorder.Header().Values("Link"); len(links) != 0 {
+		t.Errorf("unexpected Link headers for the header strategy: %v", links)
+	}
+}
+
+func TestEnforcedLanguages(t *testing.T) {
+	enforced := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.EnforcedLanguages = []string{"de"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "enforced language", config: enforced, url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "detected but not enforced", config: enforced, url: "/about", headers: map[string]string{"Accept-Language": "fr-CA"}, language: "fr-CA", result: "/about"},
+		{name: "all enforced by default", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/about", headers: map[string]string{"Accept-Language": "fr-CA"}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en"}
+	cfg.DefaultLanguage = "en"
+	cfg.EnforcedLanguages = []string{"de"}
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported enforced language")
+	}
+}
+
+func TestPathStrategyFirstSegmentOnly(t *testing.T) {
+	path := withStrategy(traefik_lang_redirect.StrategyPath, true)
+	explicit := func(cfg *traefik_lang_redirect.Config) {
+		path(cfg)
+		cfg.ExplicitOverridesHeader = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "first segment matches", config: path, url: "/de/en/page", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/en/page"},
+		{name: "only the first segment is replaced", config: path, url: "/de/en/page", headers: map[string]string{"Accept-Language": "fr-CA"}, language: "fr-CA", result: "/fr-CA/en/page", status: http.StatusFound},
+		{name: "second segment is not the language", config: path, url: "/page/en", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/page/en", status: http.StatusFound},
+		{name: "first segment is the explicit language", config: explicit, url: "/de/en/page", headers: map[string]string{"Accept-Language": "en"}, language: "de", result: "/de/en/page"},
+	})
+}
+
+func TestCountryLanguageMap(t *testing.T) {
+	geo := func(cfg *traefik_lang_redirect.Config) {
+		cfg.CountryHeader = "CF-IPCountry"
+		cfg.CountryLanguageMap = map[string]string{"at": "de", "CA": "fr-CA"}
+		cfg.FallbackLanguages = []string{"en"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "country without a header match", config: geo, url: "/", headers: map[string]string{"Accept-Language": "xx", "CF-IPCountry": "AT"}, language: "de", result: "/"},
+		{name: "header match wins", config: geo, url: "/", headers: map[string]string{"Accept-Language": "fr-CA", "CF-IPCountry": "AT"}, language: "fr-CA", result: "/"},
+		{name: "unmapped country", config: geo, url: "/", headers: map[string]string{"CF-IPCountry": "XX"}, language: "en", result: "/"},
+	})
+
+	for _, languageMap := range []map[string]string{{"AT": "de-AT"}, {"CA": "fr-ca"}} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.DefaultLanguage = "en"
+		cfg.CountryLanguageMap = languageMap
+
+		_, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect")
+		if err == nil || !strings.Contains(err.Error(), "countryLanguageMap") {
+			t.Errorf("%v: expected a countryLanguageMap error, got %v", languageMap, err)
+		}
+	}
+}
+
+func TestCountryFallbacks(t *testing.T) {
+	geo := func(cfg *traefik_lang_redirect.Config) {
+		cfg.CountryHeader = "CF-IPCountry"
+		cfg.CountryLanguageMap = map[string]string{"AT": "de"}
+		cfg.CountryFallbacks = map[string][]string{"at": {"en"}, "ca": {"fr-CA", "en"}}
+		cfg.FallbackLanguages = []string{"de"}
+		cfg.DefaultLanguage = "en"
+		cfg.SourceHeader = "X-Language-Source"
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		language string
+		source   string
+	}{
+		{name: "header match", headers: map[string]string{"Accept-Language": "fr-CA", "CF-IPCountry": "AT"}, language: "fr-CA", source: "header"},
+		{name: "geo map before fallback list", headers: map[string]string{"Accept-Language": "xx", "CF-IPCountry": "AT"}, language: "de", source: "geo"},
+		{name: "country fallback", headers: map[string]string{"Accept-Language": "xx", "CF-IPCountry": "CA"}, language: "fr-CA", source: "country-fallback"},
+		{name: "rejected country fallback", headers: map[string]string{"Accept-Language": "xx,fr;q=0", "CF-IPCountry": "CA"}, language: "en", source: "country-fallback"},
+		{name: "global fallback", headers: map[string]string{"Accept-Language": "xx", "CF-IPCountry": "XX"}, language: "de", source: "fallback"},
+		{name: "default", headers: map[string]string{"Accept-Language": "xx,de;q=0", "CF-IPCountry": "XX"}, language: "en", source: "default"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.PropagateHeader = "X-Language"
+		geo(cfg)
+
+		var language, source string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			language, source = req.Header.Get("X-Language"), req.Header.Get("X-Language-Source")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if language != test.language || source != test.source {
+			t.Errorf("%s: expected %s from %s, got %s from %s", test.name, test.language, test.source, language, source)
+		}
+	}
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.CountryFallbacks = map[string][]string{"CH": {"de", "fr"}}
+	_, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect")
+	if err == nil || !strings.Contains(err.Error(), "countryFallbacks") {
+		t.Errorf("expected a countryFallbacks error, got %v", err)
+	}
+}
+
+func TestRejectUnsupportedPathLanguage(t *testing.T) {
+	reject := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.RejectUnsupportedPathLanguage = true
+		cfg.RejectPathLanguages = []string{"it", "pt"}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "unsupported language", config: reject, url: "/it/page", headers: headers, status: http.StatusNotFound},
+		{name: "unsupported regional language", config: reject, url: "/pt-BR/page", headers: headers, status: http.StatusNotFound},
+		{name: "supported language", config: reject, url: "/DE/page", headers: headers, language: "de", result: "/DE/page"},
+		{name: "ordinary two-letter segment", config: reject, url: "/ui/page", headers: headers, language: "de", result: "/de/ui/page", status: http.StatusFound},
+		{name: "ordinary three-letter segment", config: reject, url: "/api/items", headers: headers, language: "de", result: "/de/api/items", status: http.StatusFound},
+		{name: "ordinary my segment", config: reject, url: "/my/account", headers: headers, language: "de", result: "/de/my/account", status: http.StatusFound},
+		{name: "ordinary id segment", config: reject, url: "/id/42", headers: headers, language: "de", result: "/de/id/42", status: http.StatusFound},
+		{name: "ordinary hi segment", config: reject, url: "/hi", headers: headers, language: "de", result: "/de/hi", status: http.StatusFound},
+		{name: "ordinary no segment", config: reject, url: "/no/thanks", headers: headers, language: "de", result: "/de/no/thanks", status: http.StatusFound},
+		{name: "ordinary uk segment", config: reject, url: "/uk/shop", headers: headers, language: "de", result: "/de/uk/shop", status: http.StatusFound},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/it/page", headers: headers, language: "de", result: "/de/it/page", status: http.StatusFound},
+		{
+			name: "custom status",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				reject(cfg)
+				cfg.RejectStatusCode = http.StatusGone
+			},
+			url:     "/it/page",
+			headers: headers,
+			status:  http.StatusGone,
+		},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.RejectUnsupportedPathLanguage = true
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for missing reject path languages")
+	}
+}
+
+func TestSourceHeader(t *testing.T) {
+	distinguish := func(cfg *traefik_lang_redirect.Config) {
+		cfg.DistinguishDefaultSource = true
+	}
+
+	tests := []struct {
+		name    string
+		config  func(cfg *traefik_lang_redirect.Config)
+		url     string
+		headers map[string]string
+		cookies map[string]string
+		source  string
+	}{
+		{name: "accept-language", url: "/", headers: map[string]string{"Accept-Language": "de"}, source: "header"},
+		{name: "default", url: "/", headers: map[string]string{"Accept-Language": "xx"}, source: "default"},
+		{name: "default fallback", config: distinguish, url: "/", headers: map[string]string{"Accept-Language": "xx"}, source: "default-fallback"},
+		{name: "default match", config: distinguish, url: "/", headers: map[string]string{"Accept-Language": "en"}, source: "default-match"},
+		{name: "other match", config: distinguish, url: "/", headers: map[string]string{"Accept-Language": "de"}, source: "header"},
+		{
+			name:    "fallback",
+			config:  func(cfg *traefik_lang_redirect.Config) { cfg.FallbackLanguages = []string{"de"} },
+			url:     "/",
+			headers: map[string]string{"Accept-Language": "xx"},
+			source:  "fallback",
+		},
+		{
+			name: "geo",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				cfg.CountryHeader = "CF-IPCountry"
+				cfg.CountryLanguageMap = map[string]string{"AT": "de"}
+			},
+			url:     "/",
+			headers: map[string]string{"CF-IPCountry": "AT"},
+			source:  "geo",
+		},
+		{
+			name: "path",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+				cfg.ExplicitOverridesHeader = true
+			},
+			url:     "/de/page",
+			headers: map[string]string{"Accept-Language": "en"},
+			source:  "path",
+		},
+		{
+			name: "cookie",
+			config: func(cfg *traefik_lang_redirect.Config) {
+				cfg.LanguageStrategy = traefik_lang_redirect.StrategyCookie
+				cfg.ExplicitOverridesHeader = true
+			},
+			url:     "/",
+			headers: map[string]string{"Accept-Language": "en"},
+			cookies: map[string]string{"lang": "de"},
+			source:  "cookie",
+		},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.SourceHeader = "X-Language-Source"
+		if test.config != nil {
+			test.config(cfg)
+		}
+
+		var source string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			source = req.Header.Get("X-Language-Source")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		for name, value := range test.cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if source != test.source {
+			t.Errorf("%s: expected source %q, got %q", test.name, test.source, source)
+		}
+	}
+}
+
+func TestCookieOnly(t *testing.T) {
+	cookieOnly := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.CookieOnly = true
+		cfg.CanonicalizeURL = true
+		cfg.QueryPersistence = traefik_lang_redirect.QueryPersistenceStripAfterCookie
+		cfg.PathQueryReconcile = traefik_lang_redirect.ReconcileRedirect
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "cookie is set", config: cookieOnly, url: "/about?page=2", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/about?page=2", setCookie: "lang=de"},
+		{name: "query language is kept", config: cookieOnly, url: "/about?lang=DE", headers: map[string]string{"Accept-Language": "en"}, language: "de", result: "/about?lang=DE", setCookie: "lang=de"},
+		{name: "path is kept", config: cookieOnly, url: "/fr-CA/about?lang=de", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/fr-CA/about?lang=de", setCookie: "lang=de"},
+	})
+}
+
+func TestCookieJSONField(t *testing.T) {
+	jsonCookie := func(field string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(traefik_lang_redirect.StrategyCookie, false)(cfg)
+			cfg.CookieName = "prefs"
+			cfg.CookieJSONField = field
+			cfg.ExplicitOverridesHeader = true
+		}
+	}
+	merge := func(field string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			jsonCookie(field)(cfg)
+			cfg.CookieMergeJSON = true
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+	written := "prefs=" + url.QueryEscape(`{"locale":"de"}`)
+
+	runStrategyCases(t, []strategyCase{
+		{name: "valid JSON", config: jsonCookie("locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": url.QueryEscape(`{"locale":"fr-CA","tz":"Europe/Berlin"}`)}, language: "fr-CA", result: "/"},
+		{name: "nested field", config: jsonCookie("prefs.locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": url.QueryEscape(`{"prefs":{"locale":"fr-CA"}}`)}, language: "fr-CA", result: "/"},
+		{name: "missing field", config: jsonCookie("locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": url.QueryEscape(`{"tz":"Europe/Berlin"}`)}, language: "de", result: "/", setCookie: written},
+		{name: "malformed cookie", config: jsonCookie("locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": "fr-CA"}, language: "de", result: "/", setCookie: written},
+		{name: "no cookie", config: jsonCookie("locale"), url: "/", headers: headers, language: "de", result: "/", setCookie: written},
+		{name: "overwrite", config: jsonCookie("locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": url.QueryEscape(`{"locale":"it","tz":"Europe/Berlin"}`)}, language: "de", result: "/", setCookie: written},
+		{
+			name:      "merge",
+			config:    merge("locale"),
+			url:       "/",
+			headers:   headers,
+			cookies:   map[string]string{"prefs": url.QueryEscape(`{"locale":"it","tz":"Europe/Berlin","visits":12345678901234567890}`)},
+			language:  "de",
+			result:    "/",
+			setCookie: "prefs=" + url.QueryEscape(`{"locale":"de","tz":"Europe/Berlin","visits":12345678901234567890}`),
+		},
+		{
+			name:      "merge nested field",
+			config:    merge("prefs.locale"),
+			url:       "/",
+			headers:   headers,
+			cookies:   map[string]string{"prefs": url.QueryEscape(`{"prefs":{"theme":"dark"},"tz":"Europe/Berlin"}`)},
+			language:  "de",
+			result:    "/",
+			setCookie: "prefs=" + url.QueryEscape(`{"prefs":{"locale":"de","theme":"dark"},"tz":"Europe/Berlin"}`),
+		},
+		{name: "merge malformed cookie", config: merge("locale"), url: "/", headers: headers, cookies: map[string]string{"prefs": "fr-CA"}, language: "de", result: "/", setCookie: written},
+	})
+}
+
+func TestSkipPrefetch(t *testing.T) {
+	redirect := withStrategy(traefik_lang_redirect.StrategyPath, true)
+	disabled := func(cfg *traefik_lang_redirect.Config) {
+		redirect(cfg)
+		cfg.SkipPrefetch = false
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "sec-purpose", config: redirect, url: "/about", headers: map[string]string{"Accept-Language": "de", "Sec-Purpose": "prefetch"}, language: "de", result: "/de/about"},
+		{name: "prerender", config: redirect, url: "/about", headers: map[string]string{"Accept-Language": "de", "Sec-Purpose": "prefetch;prerender"}, language: "de", result: "/de/about"},
+		{name: "purpose", config: redirect, url: "/about", headers: map[string]string{"Accept-Language": "de", "Purpose": "prefetch"}, language: "de", result: "/de/about"},
+		{name: "disabled", config: disabled, url: "/about", headers: map[string]string{"Accept-Language": "de", "Sec-Purpose": "prefetch"}, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "regular load", config: redirect, url: "/about", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about", status: http.StatusFound},
+	})
+}
+
+func TestExpandBaseTo(t *testing.T) {
+	expand := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.Languages = []string{"en-US", "en-GB", "de"}
+			cfg.DefaultLanguage = "de"
+			cfg.ExpandBaseTo = map[string]string{"EN": "en-GB"}
+		}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "path write", config: expand(traefik_lang_redirect.StrategyPath), url: "/about", headers: map[string]string{"Accept-Language": "en"}, language: "en-GB", result: "/en-GB/about", status: http.StatusFound},
+		{name: "regional base match", config: expand(traefik_lang_redirect.StrategyPath), url: "/about", headers: map[string]string{"Accept-Language": "en-AU"}, language: "en-GB", result: "/en-GB/about", status: http.StatusFound},
+		{name: "exact match", config: expand(traefik_lang_redirect.StrategyPath), url: "/about", headers: map[string]string{"Accept-Language": "en-US"}, language: "en-US", result: "/en-US/about", status: http.StatusFound},
+		{name: "cookie write", config: expand(traefik_lang_redirect.StrategyCookie), url: "/about", headers: map[string]string{"Accept-Language": "en"}, language: "en-GB", result: "/about", setCookie: "lang=en-GB"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en-US"}
+	cfg.DefaultLanguage = "en-US"
+	cfg.ExpandBaseTo = map[string]string{"en": "en-GB"}
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported expansion")
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	collapse := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.CollapseSlashes = true
+	}
+	absolute := func(cfg *traefik_lang_redirect.Config) {
+		collapse(cfg)
+		cfg.AbsoluteRedirect = true
+	}
+	rewrite := func(cfg *traefik_lang_redirect.Config) {
+		collapse(cfg)
+		cfg.RedirectAfterHandling = false
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "language path", config: collapse, url: "/de//products", headers: headers, language: "de", result: "/de/products", status: http.StatusFound},
+		{name: "prefixed path", config: collapse, url: "/products//list", headers: headers, language: "de", result: "/de/products/list", status: http.StatusFound},
+		{name: "absolute redirect", config: absolute, url: "/de//products", headers: headers, language: "de", result: "http://example.com/de/products", status: http.StatusFound},
+		{name: "rewrite only", config: rewrite, url: "/de//products", headers: headers, language: "de", result: "/de/products"},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/de//products", headers: headers, language: "de", result: "/de//products"},
+	})
+}
+
+func TestQueryValueDelimiter(t *testing.T) {
+	delimited := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyQuery, false)(cfg)
+		cfg.ExplicitOverridesHeader = true
+		cfg.QueryValueDelimiter = ","
+	}
+	headers := map[string]string{"Accept-Language": "en"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "first supported", config: delimited, url: "/?lang=xx,de", headers: headers, language: "de", result: "/?lang=de"},
+		{name: "preference order", config: delimited, url: "/?lang=fr-CA,+de", headers: headers, language: "fr-CA", result: "/?lang=fr-CA"},
+		{name: "nothing supported", config: delimited, url: "/?lang=xx,yy", headers: headers, language: "en", result: "/?lang=xx,yy"},
+		{name: "single value", config: delimited, url: "/?lang=de", headers: headers, language: "de", result: "/?lang=de"},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyQuery, false), url: "/?lang=xx,de", headers: headers, language: "en", result: "/?lang=xx,de"},
+	})
+}
+
+func TestNotFoundRedirectPath(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.NotFoundRedirectPath = "/{lang}/404"
+
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/about" {
+			_, _ = io.WriteString(rw, "about")
+			return
+		}
+		http.NotFound(rw, req)
+	}))
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		status   int
+		location string
+		body     string
+	}{
+		{name: "missing page", method: http.MethodGet, url: "/missing", status: http.StatusFound, location: "/de/404"},
+		{name: "head request", method: http.MethodHead, url: "/missing", status: http.StatusFound, location: "/de/404"},
+		{name: "existing page", method: http.MethodGet, url: "/about", status: http.StatusOK, body: "about"},
+		{name: "not-found page", method: http.MethodGet, url: "/de/404", status: http.StatusNotFound, body: "404 page not found\n"},
+		{name: "post request", method: http.MethodPost, url: "/missing", status: http.StatusNotFound, body: "404 page not found\n"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		req.Header.Set("Accept-Language", "de")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: expected location %q, got %q", test.name, test.location, location)
+		}
+		if body := recorder.Body.String(); body != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.name, test.body, body)
+		}
+	}
+
+	cfg.NotFoundRedirectPath = "{lang}/404"
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for a relative not-found path")
+	}
+}
+
+func TestNoRedirectParam(t *testing.T) {
+	noRedirect := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.NoRedirectParam = "noredirect"
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "path suppressed", config: noRedirect(traefik_lang_redirect.StrategyPath), url: "/about?noredirect=1&page=2", headers: headers, language: "de", result: "/de/about?page=2"},
+		{name: "query suppressed", config: noRedirect(traefik_lang_redirect.StrategyQuery), url: "/about?noredirect", headers: headers, language: "de", result: "/about?lang=de"},
+		{name: "other params untouched", config: noRedirect(traefik_lang_redirect.StrategyPath), url: "/about?z=a%2Bb&noredirect=1&a=1", headers: headers, language: "de", result: "/de/about?z=a%2Bb&a=1"},
+		{name: "without flag", config: noRedirect(traefik_lang_redirect.StrategyPath), url: "/about?page=2", headers: headers, language: "de", result: "/de/about?page=2", status: http.StatusFound},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/about?noredirect=1", headers: headers, language: "de", result: "/de/about?noredirect=1", status: http.StatusFound},
+	})
+}
+
+func TestUseFirstLanguageAsDefault(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"de", "en"}
+	cfg.PropagateHeader = "X-Language"
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Fatal("expected an error for a missing default language")
+	}
+
+	cfg.UseFirstLanguageAsDefault = true
+	var lang string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "ja")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if lang != "de" {
+		t.Errorf("expected the first language, got %q", lang)
+	}
+}
+
+func TestLanguageTrailer(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageTrailer = "X-Language"
+
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, "chunk")
+		rw.(http.Flusher).Flush()
+		_, _ = io.WriteString(rw, "chunk")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	result := recorder.Result()
+	if declared := result.Header.Get("Trailer"); declared != "X-Language" {
+		t.Errorf("expected the trailer to be announced, got %q", declared)
+	}
+	if trailer := result.Trailer.Get("X-Language"); trailer != "de" {
+		t.Errorf("expected trailer de, got %q", trailer)
+	}
+}
+
+func TestBackendHostTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategy   string
+		headerWins bool
+		url        string
+		header     string
+		host       string
+		path       string
+	}{
+		{name: "header strategy", strategy: traefik_lang_redirect.StrategyHeader, url: "/about", header: "de", host: "de.internal", path: "/about"},
+		{name: "path strategy", strategy: traefik_lang_redirect.StrategyPath, url: "/fr-CA/about", header: "de", host: "fr.internal", path: "/fr-CA/about"},
+		{name: "default language", strategy: traefik_lang_redirect.StrategyPath, url: "/about", header: "ja", host: "en.internal", path: "/about"},
+		{name: "path and header conflict", strategy: traefik_lang_redirect.StrategyPath, headerWins: true, url: "/fr-CA/about", header: "en", host: "fr.internal", path: "/fr-CA/about"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = test.strategy
+		cfg.ExplicitOverridesHeader = !test.headerWins
+		cfg.BackendLanguageFormat = traefik_lang_redirect.BackendFormatISO6391
+		cfg.BackendHostTemplate = "{lang}.internal"
+
+		var host, path string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			host, path = req.Host, req.URL.Path
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.Header.Set("Accept-Language", test.header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", test.name, recorder.Code)
+		}
+		if host != test.host {
+			t.Errorf("%s: expected host %q, got %q", test.name, test.host, host)
+		}
+		if path != test.path {
+			t.Errorf("%s: expected path %q, got %q", test.name, test.path, path)
+		}
+	}
+}
+
+func TestOverwriteUpstreamAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name      string
+		overwrite bool
+		url       string
+		expected  string
+	}{
+		{name: "path language", overwrite: true, url: "/fr-CA/about", expected: "fr-CA"},
+		{name: "rewritten path", overwrite: true, url: "/about", expected: "de"},
+		{name: "disabled", url: "/fr-CA/about", expected: "de,en;q=0.5"},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		cfg.ExplicitOverridesHeader = true
+		cfg.OverwriteUpstreamAcceptLanguage = test.overwrite
+
+		var acceptLanguage string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			acceptLanguage = req.Header.Get("Accept-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.Header.Set("Accept-Language", "de,en;q=0.5")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if acceptLanguage != test.expected {
+			t.Errorf("%s: expected Accept-Language %q, got %q", test.name, test.expected, acceptLanguage)
+		}
+	}
+}
+
+func TestCookieOnSuccessOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		deferred  bool
+		next      http.HandlerFunc
+		setCookie bool
+	}{
+		{name: "success", deferred: true, next: func(rw http.ResponseWriter, req *http.Request) { _, _ = io.WriteString(rw, "ok") }, setCookie: true},
+		{name: "implicit success", deferred: true, next: func(rw http.ResponseWriter, req *http.Request) {}, setCookie: true},
+		{name: "redirect", deferred: true, next: func(rw http.ResponseWriter, req *http.Request) { http.Redirect(rw, req, "/login", http.StatusFound) }, setCookie: true},
+		{name: "server error", deferred: true, next: func(rw http.ResponseWriter, req *http.Request) { rw.WriteHeader(http.StatusBadGateway) }, setCookie: false},
+		{name: "client error", deferred: true, next: func(rw http.ResponseWriter, req *http.Request) { http.NotFound(rw, req) }, setCookie: false},
+		{name: "disabled", next: func(rw http.ResponseWriter, req *http.Request) { rw.WriteHeader(http.StatusBadGateway) }, setCookie: true},
+	}
+
+	for _, test := range tests {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = traefik_lang_redirect.StrategyCookie
+		cfg.CookieOnSuccessOnly = test.deferred
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			http.SetCookie(rw, &http.Cookie{Name: "session", Value: "1"})
+			test.next(rw, req)
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", "de")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		var langCookie, sessionCookie bool
+		for _, cookie := range recorder.Result().Cookies() {
+			langCookie = langCookie || cookie.Name == "lang" && cookie.Value == "de"
+			sessionCookie = sessionCookie || cookie.Name == "session"
+		}
+		if langCookie != test.setCookie {
+			t.Errorf("%s: expected language cookie %t, got %t", test.name, test.setCookie, langCookie)
+		}
+		if !sessionCookie {
+			t.Errorf("%s: the backend cookie is missing", test.name)
+		}
+	}
+}
+
+func TestReadWriteStrategy(t *testing.T) {
+	split := func(read, write string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			cfg.ReadStrategy = read
+			cfg.WriteStrategy = write
+			cfg.RedirectAfterHandling = true
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "header read, path write", config: split(traefik_lang_redirect.StrategyHeader, traefik_lang_redirect.StrategyPath), url: "/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "header read ignores the path", config: split(traefik_lang_redirect.StrategyHeader, traefik_lang_redirect.StrategyPath), url: "/fr-CA/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "header read, path already written", config: split(traefik_lang_redirect.StrategyHeader, traefik_lang_redirect.StrategyPath), url: "/de/about", headers: headers, language: "de", result: "/de/about"},
+		{name: "path read and write", config: split(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.StrategyPath), url: "/fr-CA/about", headers: headers, language: "fr-CA", result: "/fr-CA/about"},
+		{name: "cookie read, path write", config: split(traefik_lang_redirect.StrategyCookie, traefik_lang_redirect.StrategyPath), url: "/about", headers: headers, cookies: map[string]string{"lang": "fr-CA"}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "cookie read rewrites another path language", config: split(traefik_lang_redirect.StrategyCookie, traefik_lang_redirect.StrategyPath), url: "/de/about", headers: headers, cookies: map[string]string{"lang": "fr-CA"}, language: "fr-CA", result: "/fr-CA/about", status: http.StatusFound},
+		{name: "cookie read, path already written", config: split(traefik_lang_redirect.StrategyCookie, traefik_lang_redirect.StrategyPath), url: "/fr-CA/about", headers: headers, cookies: map[string]string{"lang": "fr-CA"}, language: "fr-CA", result: "/fr-CA/about"},
+		{name: "cookie read without cookie", config: split(traefik_lang_redirect.StrategyCookie, traefik_lang_redirect.StrategyPath), url: "/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "path read, cookie write", config: split(traefik_lang_redirect.StrategyPath, traefik_lang_redirect.StrategyCookie), url: "/fr-CA/about", headers: headers, language: "fr-CA", result: "/fr-CA/about", setCookie: "lang=fr-CA"},
+	})
+
+	for _, pair := range [][2]string{{"header", ""}, {"", "path"}, {"header", "url"}, {"referer", "path"}} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.ReadStrategy, cfg.WriteStrategy = pair[0], pair[1]
+		if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+			t.Errorf("%v: expected an error for the strategy pair", pair)
+		}
+	}
+}
+
+func TestRedirectBody(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.RedirectStatusCode = http.StatusMovedPermanently
+	cfg.PreserveQueryParams = []string{"page", "q"}
+	cfg.RedirectBody = true
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/about?page=2&q=%3Cb%3E", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	location := recorder.Header().Get("Location")
+	if recorder.Code != http.StatusMovedPermanently || location != "/about?lang=de&page=2&q=%3Cb%3E" {
+		t.Fatalf("unexpected redirect: %d %s", recorder.Code, location)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type: %s", contentType)
+	}
+	body := recorder.Body.String()
+	for _, expected := range []string{`<html lang="de">`, `<link rel="canonical" href="/about?lang=de&amp;page=2&amp;q=%3Cb%3E">`, `<a href="/about?lang=de&amp;page=2&amp;q=%3Cb%3E">`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s in the body: %s", expected, body)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodHead, "/about", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusMovedPermanently || recorder.Body.Len() != 0 {
+		t.Errorf("unexpected HEAD response: %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	cfg.RedirectBodyTemplate = `<p lang="{lang}">Weiter zu <a href="{location}">{location}</a></p>`
+	req = httptest.NewRequest(http.MethodGet, "/about?page=2", nil)
+	req.Header.Set("Accept-Language", "de")
+	recorder = httptest.NewRecorder()
+	newHandler(t, cfg, nil).ServeHTTP(recorder, req)
+
+	if body := recorder.Body.String(); body != `<p lang="de">Weiter zu <a href="/about?lang=de&amp;page=2">/about?lang=de&amp;page=2</a></p>` {
+		t.Errorf("expected the custom template, got %q", body)
+	}
+
+	cfg.RedirectBodyTemplate = "<p>Moved</p>"
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Errorf("expected an error for a template without {location}")
+	}
+}
+
+func TestCookiePrecedence(t *testing.T) {
+	cookieWins := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.CookiePrecedence = true
+		}
+	}
+	headers := map[string]string{"Accept-Language": "fr-CA"}
+	cookies := map[string]string{"lang": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "cookie wins", config: cookieWins(traefik_lang_redirect.StrategyCookie), url: "/about", headers: headers, cookies: cookies, language: "de", result: "/about"},
+		{name: "cookie wins for the path", config: cookieWins(traefik_lang_redirect.StrategyPath), url: "/about", headers: headers, cookies: cookies, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "unsupported cookie", config: cookieWins(traefik_lang_redirect.StrategyCookie), url: "/about", headers: headers, cookies: map[string]string{"lang": "xx"}, language: "fr-CA", result: "/about", setCookie: "lang=fr-CA"},
+		{name: "header wins", config: withStrategy(traefik_lang_redirect.StrategyCookie, true), url: "/about", headers: headers, cookies: cookies, language: "fr-CA", result: "/about", setCookie: "lang=fr-CA"},
+	})
+}
+
+func TestIgnoreLanguages(t *testing.T) {
+	ignore := func(languages ...string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			cfg.DefaultLanguage = "fr-CA"
+			cfg.IgnoreLanguages = languages
+		}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "lower quality match wins", config: ignore("en-US"), url: "/", headers: map[string]string{"Accept-Language": "en-US,de;q=0.5"}, language: "de", result: "/"},
+		{name: "only option", config: ignore("en-US"), url: "/", headers: map[string]string{"Accept-Language": "en-US,xx;q=0.5"}, language: "en", result: "/"},
+		{name: "other regions kept", config: ignore("en-US"), url: "/", headers: map[string]string{"Accept-Language": "en-GB,de;q=0.5"}, language: "en", result: "/"},
+		{name: "bare base covers regions", config: ignore("EN"), url: "/", headers: map[string]string{"Accept-Language": "en-GB,en;q=0.9,de;q=0.5"}, language: "de", result: "/"},
+		{name: "disabled", config: ignore(), url: "/", headers: map[string]string{"Accept-Language": "en-US,de;q=0.5"}, language: "en", result: "/"},
+	})
+}
+
+func TestAcceptLanguageHeaders(t *testing.T) {
+	headers := func(cfg *traefik_lang_redirect.Config) {
+		cfg.AcceptLanguageHeaders = []string{"Accept-Language", "X-Accept-Language"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "fallback header", config: headers, url: "/", headers: map[string]string{"X-Accept-Language": "de"}, language: "de", result: "/"},
+		{name: "primary header first", config: headers, url: "/", headers: map[string]string{"Accept-Language": "fr-CA", "X-Accept-Language": "de"}, language: "fr-CA", result: "/"},
+		{name: "default headers", url: "/", headers: map[string]string{"X-Accept-Language": "de"}, language: "en", result: "/"},
+	})
+}
+
+func TestSingleRedirect(t *testing.T) {
+	slash := func(cfg *traefik_lang_redirect.Config) {
+		withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+		cfg.NormalizeTrailingSlash = traefik_lang_redirect.TrailingSlashAdd
+	}
+	combined := func(cfg *traefik_lang_redirect.Config) {
+		slash(cfg)
+		cfg.PathQueryReconcile = traefik_lang_redirect.ReconcileRedirect
+		cfg.CanonicalizeURL = true
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "language prefix and trailing slash", config: slash, url: "/about?x=1", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about/?x=1", status: http.StatusFound},
+		{name: "reconcile and language switch", config: combined, url: "/fr-CA/about?lang=en", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about/", status: http.StatusFound},
+		{name: "reconcile and canonical spelling", config: combined, url: "/DE/about/?lang=fr-CA", headers: map[string]string{"Accept-Language": "de"}, language: "de", result: "/de/about/", status: http.StatusFound},
+	})
+}
+
+func TestReadFormLanguage(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyQuery
+	cfg.RedirectAfterHandling = true
+	cfg.ReadFormLanguage = true
+	cfg.PropagateHeader = "X-Language"
+
+	var lang, body, target string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+		target = req.URL.String()
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = string(content)
+	}))
+
+	tests := []struct {
+		contentType string
+		body        string
+		lang        string
+		target      string
+	}{
+		{contentType: "application/x-www-form-urlencoded", body: "user=jo&language=de", lang: "de", target: "/login?lang=de"},
+		{contentType: "application/x-www-form-urlencoded; charset=utf-8", body: "language=xx", lang: "en", target: "/login"},
+		{contentType: "application/json", body: `{"language":"de"}`, lang: "en", target: "/login"},
+		{contentType: "application/x-www-form-urlencoded", body: strings.Repeat("a", 70<<10) + "&language=de", lang: "en", target: "/login"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		req.Header.Set("Accept-Language", "en")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", test.contentType, recorder.Code)
+		}
+		if lang != test.lang || target != test.target {
+			t.Errorf("%s: expected %s at %s, got %s at %s", test.contentType, test.lang, test.target, lang, target)
+		}
+		if body != test.body {
+			t.Errorf("%s: body not restored, got %d bytes", test.contentType, len(body))
+		}
+	}
+}
+
+type countingResolver struct {
+	mu        sync.Mutex
+	countries map[string]string
+	calls     int
+}
+
+func (c *countingResolver) Country(ip string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	country, ok := c.countries[ip]
+	return country, ok
+}
+
+func (c *countingResolver) callCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func newGeoHandler(tb testing.TB, ttl string, resolver *countingResolver, next http.Handler) http.Handler {
+	tb.Helper()
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.CountryLanguageMap = map[string]string{"AT": "de"}
+	cfg.GeoCacheTTL = ttl
+	cfg.PropagateHeader = "X-Language"
+
+	handler, err := traefik_lang_redirect.NewWithOptions(context.Background(), next, cfg, "lang-redirect", traefik_lang_redirect.WithCountryResolver(resolver))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return handler
+}
+
+func TestGeoCache(t *testing.T) {
+	resolver := &countingResolver{countries: map[string]string{"192.0.2.1": "AT"}}
+	var lang string
+	handler := newGeoHandler(t, "50ms", resolver, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lang = req.Header.Get("X-Language")
+	}))
+
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve()
+	serve()
+	if lang != "de" {
+		t.Errorf("unexpected language: %s", lang)
+	}
+	if calls := resolver.callCount(); calls != 1 {
+		t.Errorf("expected a cached lookup, got %d calls", calls)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	serve()
+	if calls := resolver.callCount(); calls != 2 {
+		t.Errorf("expected a lookup after expiry, got %d calls", calls)
+	}
+}
+
+func TestGeoCacheConcurrent(t *testing.T) {
+	resolver := &countingResolver{countries: map[string]string{}}
+	handler := newGeoHandler(t, "1m", resolver, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "192.0.2." + strconv.Itoa((i*500+j)%2000) + ":1234"
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 2000 distinct IPs do not fit the default cache of 1024
+	if calls := resolver.callCount(); calls < 2000 {
+		t.Errorf("expected every IP to be resolved at least once, got %d calls", calls)
+	}
+}
+
+func BenchmarkGeoCache(b *testing.B) {
+	resolver := &countingResolver{countries: map[string]string{"192.0.2.1": "AT"}}
+	handler := newGeoHandler(b, "1m", resolver, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		recorder := httptest.NewRecorder()
+		for pb.Next() {
+			handler.ServeHTTP(recorder, req)
+		}
+	})
+}
+
+func TestRequestsWithoutPath(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectAfterHandling = true
+	cfg.RejectUnsupportedPathLanguage = true
+	cfg.RejectPathLanguages = []string{"it"}
+
+	tests := []struct {
+		method   string
+		target   string
+		url      string
+		status   int
+		location string
+	}{
+		{method: http.MethodConnect, target: "example.com:443", url: "//example.com:443", status: http.StatusOK},
+		{method: http.MethodGet, target: "http://example.com", url: "http://example.com", status: http.StatusOK},
+		{method: http.MethodOptions, target: "*", url: "*", status: http.StatusOK},
+		{method: http.MethodGet, target: "http://example.com/about", status: http.StatusFound, location: "http://example.com/de/about"},
+	}
+
+	for _, test := range tests {
+		var url string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			url = req.URL.String()
+		}))
+
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.Header.Set("Accept-Language", "de")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.target, test.status, recorder.Code)
+		}
+		if url != test.url {
+			t.Errorf("%s %s: expected %q to be passed through, got %q", test.method, test.target, test.url, url)
+		}
+		if location := recorder.Header().Get("Location"); location != test.location {
+			t.Errorf("%s %s: expected Location %q, got %q", test.method, test.target, test.location, location)
+		}
+	}
+}
+
+func TestAlsoPropagateHeader(t *testing.T) {
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de", "fr"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.AlsoPropagateHeader = "X-Language"
+	cfg.EnforcedLanguages = []string{"de"}
+
+	tests := []struct {
+		url      string
+		header   string
+		path     string
+		language string
+	}{
+		{url: "/about", header: "de", path: "/de/about", language: "de"},
+		{url: "/about", header: "en", path: "/about", language: "en"},
+		{url: "/fr/about", header: "de", path: "/de/about", language: "de"},
+		// fr is detected but not enforced, the request keeps the path language
+		{url: "/de/about", header: "fr", path: "/de/about", language: "de"},
+	}
+
+	for _, test := range tests {
+		var path, language string
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			path = req.URL.Path
+			language = req.Header.Get("X-Language")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.Header.Set("Accept-Language", test.header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if path != test.path || language != test.language {
+			t.Errorf("%s (%s): expected %s with %s, got %s with %s", test.url, test.header, test.path, test.language, path, language)
+		}
+	}
+}
+
+func TestRedirectMarkerParam(t *testing.T) {
+	marker := func(strategy string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(strategy, true)(cfg)
+			cfg.RedirectMarkerParam = "_lr"
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "path redirect", config: marker(traefik_lang_redirect.StrategyPath), url: "/about?page=2", headers: headers, language: "de", result: "/de/about?page=2&_lr=1", status: http.StatusFound},
+		{name: "query redirect", config: marker(traefik_lang_redirect.StrategyQuery), url: "/about", headers: headers, language: "de", result: "/about?lang=de&_lr=1", status: http.StatusFound},
+		{name: "original order", config: marker(traefik_lang_redirect.StrategyPath), url: "/about?z=1&a=%41", headers: headers, language: "de", result: "/de/about?z=1&a=%41&_lr=1", status: http.StatusFound},
+		{name: "passed on", config: marker(traefik_lang_redirect.StrategyPath), url: "/de/about?_lr=1&page=2", headers: headers, language: "de", result: "/de/about?_lr=1&page=2"},
+		{name: "not carried into a new redirect", config: marker(traefik_lang_redirect.StrategyPath), url: "/fr-CA/about?_lr=1", headers: headers, language: "de", result: "/de/about?_lr=1", status: http.StatusFound},
+		{name: "disabled", config: withStrategy(traefik_lang_redirect.StrategyPath, true), url: "/de/about?_lr=1", headers: headers, language: "de", result: "/de/about?_lr=1"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "de"}
+	cfg.DefaultLanguage = "en"
+	cfg.LanguageStrategy = traefik_lang_redirect.StrategyPath
+	cfg.RedirectMarkerParam = "_lr"
+	cfg.EmitAlternateLinks = true
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/de/about?_lr=1&page=2", nil)
+	req.Header.Set("Accept-Language", "de")
+	newHandler(t, cfg, nil).ServeHTTP(recorder, req)
+	links := recorder.Header().Values("Link")
+	if len(links) == 0 {
+		t.Fatal("expected alternate links")
+	}
+	for _, link := range links {
+		if strings.Contains(link, "_lr") {
+			t.Errorf("expected the marker to be dropped from alternate links, got %s", link)
+		}
+	}
+}
+
+func TestSkipIfHandled(t *testing.T) {
+	chain := func(skip bool, proxies []string, next http.Handler) http.Handler {
+		inner := traefik_lang_redirect.CreateConfig()
+		inner.Languages = []string{"en", "de"}
+		inner.DefaultLanguage = "en"
+		inner.LanguageStrategy = traefik_lang_redirect.StrategyPath
+		inner.PropagateHeader = "X-Inner-Language"
+		inner.SkipIfHandled = skip
+		inner.TrustedProxies = proxies
+		innerHandler, err := traefik_lang_redirect.New(context.Background(), next, inner, "inner")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outer := traefik_lang_redirect.CreateConfig()
+		outer.Languages = []string{"en", "de"}
+		outer.DefaultLanguage = "en"
+		outer.SkipIfHandled = skip
+		outer.TrustedProxies = proxies
+		outerHandler, err := traefik_lang_redirect.New(context.Background(), innerHandler, outer, "outer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return outerHandler
+	}
+
+	tests := []struct {
+		name     string
+		skip     bool
+		proxies  []string
+		handled  string
+		path     string
+		inner    string
+		upstream string
+	}{
+		{name: "second instance is a no-op", skip: true, path: "/about", upstream: "outer"},
+		{name: "client header is ignored", skip: true, handled: "edge", path: "/about", upstream: "outer"},
+		{name: "header from a trusted proxy", skip: true, proxies: []string{"192.0.2.1"}, handled: "edge", path: "/about", upstream: "edge"},
+		{name: "header from an untrusted proxy", skip: true, proxies: []string{"10.0.0.0/8"}, handled: "edge", path: "/about", upstream: "outer"},
+		{name: "disabled", skip: false, path: "/de/about", inner: "de"},
+		{name: "disabled ignores the header", skip: false, handled: "edge", path: "/de/about", inner: "de", upstream: "edge"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path, inner, upstream string
+			handler := chain(test.skip, test.proxies, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				path = req.URL.Path
+				inner = req.Header.Get("X-Inner-Language")
+				upstream = req.Header.Get(traefik_lang_redirect.HandledHeader)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/about", nil)
+			req.Header.Set("Accept-Language", "de")
+			if test.handled != "" {
+				req.Header.Set(traefik_lang_redirect.HandledHeader, test.handled)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if path != test.path || inner != test.inner || upstream != test.upstream {
+				t.Errorf("expected %s with %q handled by %q, got %s with %q handled by %q", test.path, test.inner, test.upstream, path, inner, upstream)
+			}
+		})
+	}
+}
+
+func TestScriptSignificance(t *testing.T) {
+	scripts := func(languages ...string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			cfg.Languages = append([]string{"en"}, languages...)
+			cfg.DefaultLanguage = "en"
+		}
+	}
+	expanded := func(cfg *traefik_lang_redirect.Config) {
+		scripts("zh-Hans")(cfg)
+		cfg.ExpandBaseTo = map[string]string{"zh": "zh-Hans"}
+	}
+	defaulted := func(cfg *traefik_lang_redirect.Config) {
+		scripts("zh-Hans")(cfg)
+		cfg.BaseLanguageDefaults = map[string]string{"zh": "zh-Hans"}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "other script", config: scripts("zh-Hans"), url: "/", headers: map[string]string{"Accept-Language": "zh-Hant"}, language: "en", result: "/"},
+		{name: "other script expansion", config: expanded, url: "/", headers: map[string]string{"Accept-Language": "zh-Hant"}, language: "en", result: "/"},
+		{name: "other script base default", config: defaulted, url: "/", headers: map[string]string{"Accept-Language": "zh-Hant-TW"}, language: "en", result: "/"},
+		{name: "bare base expansion", config: expanded, url: "/", headers: map[string]string{"Accept-Language": "zh"}, language: "zh-Hans", result: "/"},
+		{name: "same script expansion", config: expanded, url: "/", headers: map[string]string{"Accept-Language": "zh-Hans-SG"}, language: "zh-Hans", result: "/"},
+		{name: "script before base", config: scripts("zh", "zh-Hant"), url: "/", headers: map[string]string{"Accept-Language": "zh-Hant-TW"}, language: "zh-Hant", result: "/"},
+		{name: "bare base", config: scripts("zh", "zh-Hans"), url: "/", headers: map[string]string{"Accept-Language": "zh-Hant"}, language: "zh", result: "/"},
+		{name: "later script retried", config: scripts("zh-Hans"), url: "/", headers: map[string]string{"Accept-Language": "zh-Hant-TW, zh-Hans-CN;q=0.5"}, language: "zh-Hans", result: "/"},
+	})
+}
+
+func TestPathRegex(t *testing.T) {
+	filtered := func(include, exclude string) func(cfg *traefik_lang_redirect.Config) {
+		return func(cfg *traefik_lang_redirect.Config) {
+			withStrategy(traefik_lang_redirect.StrategyPath, true)(cfg)
+			cfg.IncludePathRegex = include
+			cfg.ExcludePathRegex = exclude
+		}
+	}
+	headers := map[string]string{"Accept-Language": "de"}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "included", config: filtered(`^/(shop|blog)/`, ""), url: "/shop/cart", headers: headers, language: "de", result: "/de/shop/cart", status: http.StatusFound},
+		{name: "not included", config: filtered(`^/(shop|blog)/`, ""), url: "/about", headers: headers, result: "/about"},
+		{name: "excluded", config: filtered("", `^/api/`), url: "/api/items", headers: headers, result: "/api/items"},
+		{name: "not excluded", config: filtered("", `^/api/`), url: "/about", headers: headers, language: "de", result: "/de/about", status: http.StatusFound},
+		{name: "excluded within included", config: filtered(`^/blog/`, `/feed$`), url: "/blog/feed", headers: headers, result: "/blog/feed"},
+		{name: "included and not excluded", config: filtered(`^/blog/`, `/feed$`), url: "/blog/post", headers: headers, language: "de", result: "/de/blog/post", status: http.StatusFound},
+	})
+
+	for _, test := range []struct{ include, exclude string }{{include: `^/(shop`}, {exclude: `[`}} {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de"}
+		cfg.DefaultLanguage = "en"
+		cfg.IncludePathRegex = test.include
+		cfg.ExcludePathRegex = test.exclude
+		if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+			t.Errorf("expected an error for the patterns %q and %q", test.include, test.exclude)
+		}
+	}
+}
+
+func TestRegionGroups(t *testing.T) {
+	grouped := func(cfg *traefik_lang_redirect.Config) {
+		cfg.Languages = []string{"en", "es-ES", "es-419"}
+		cfg.DefaultLanguage = "en"
+		cfg.BaseLanguageDefaults = map[string]string{"es": "es-ES"}
+		cfg.RegionGroups = map[string]string{"MX, ar": "es-419", "CO": "es-419"}
+	}
+	header := func(value string) map[string]string {
+		return map[string]string{"Accept-Language": value}
+	}
+
+	runStrategyCases(t, []strategyCase{
+		{name: "grouped region", config: grouped, url: "/", headers: header("es-MX"), language: "es-419", result: "/"},
+		{name: "group member", config: grouped, url: "/", headers: header("es-ar"), language: "es-419", result: "/"},
+		{name: "single region", config: grouped, url: "/", headers: header("es-CO"), language: "es-419", result: "/"},
+		{name: "exact match stays", config: grouped, url: "/", headers: header("es-ES"), language: "es-ES", result: "/"},
+		{name: "other region", config: grouped, url: "/", headers: header("es-CL"), language: "es-ES", result: "/"},
+		{name: "other base", config: grouped, url: "/", headers: header("en-MX"), language: "en", result: "/"},
+		{name: "with script", config: grouped, url: "/", headers: header("es-Latn-MX"), language: "es-419", result: "/"},
+	})
+
+	cfg := traefik_lang_redirect.CreateConfig()
+	cfg.Languages = []string{"en", "es-ES"}
+	cfg.DefaultLanguage = "en"
+	cfg.RegionGroups = map[string]string{"MX": "es-419"}
+	if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+		t.Error("expected an error for an unsupported region group locale")
+	}
+}
+
+func TestShowPickerOnNoMatch(t *testing.T) {
+	picker := func(strategy string) *traefik_lang_redirect.Config {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = strategy
+		cfg.ShowPickerOnNoMatch = true
+		return cfg
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		url      string
+		header   string
+		links    []string
+	}{
+		{name: "path", strategy: traefik_lang_redirect.StrategyPath, url: "/about", header: "ja", links: []string{`href="/de/about" hreflang="de"`, `href="/fr-CA/about" hreflang="fr-CA"`, `hreflang="en"`}},
+		{name: "query", strategy: traefik_lang_redirect.StrategyQuery, url: "/about?page=2", header: "ja", links: []string{`href="/about?lang=de&amp;page=2"`, `href="/about?lang=fr-CA&amp;page=2"`, `hreflang="en"`}},
+		{name: "cookie switch", strategy: traefik_lang_redirect.StrategyCookie, url: "/about", header: "", links: []string{`href="/about?lang=en"`, `href="/about?lang=de"`, `href="/about?lang=fr-CA"`}},
+		{name: "match", strategy: traefik_lang_redirect.StrategyPath, url: "/about", header: "de"},
+		{name: "language in the URL", strategy: traefik_lang_redirect.StrategyPath, url: "/de/about", header: "ja"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			handler := newHandler(t, picker(test.strategy), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Set("Accept-Language", test.header)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			body := recorder.Body.String()
+			if shown := strings.Contains(body, "<ul>"); shown != (len(test.links) > 0) {
+				t.Fatalf("expected the picker to be shown: %t, got %q", len(test.links) > 0, body)
+			}
+			if len(test.links) == 0 {
+				return
+			}
+			if called || recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html") {
+				t.Errorf("expected a picker page, got %d %q (backend called: %t)", recorder.Code, recorder.Header().Get("Content-Type"), called)
+			}
+			for _, link := range test.links {
+				if !strings.Contains(body, link) {
+					t.Errorf("expected the picker to contain %s, got %q", link, body)
+				}
+			}
+			if count := strings.Count(body, "<a "); count != 3 {
+				t.Errorf("expected a link per language, got %d", count)
+			}
+		})
+	}
+}
+
+func TestPickerTemplate(t *testing.T) {
+	picker := func(strategy string) *traefik_lang_redirect.Config {
+		cfg := traefik_lang_redirect.CreateConfig()
+		cfg.Languages = []string{"en", "de", "fr-CA"}
+		cfg.DefaultLanguage = "en"
+		cfg.LanguageStrategy = strategy
+		cfg.ShowPickerOnNoMatch = true
+		return cfg
+	}
+
+	cfg := picker(traefik_lang_redirect.StrategyPath)
+	cfg.PickerTemplate = `<nav>{links}</nav>`
+	recorder := httptest.NewRecorder()
+	newHandler(t, cfg, nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := recorder.Body.String(); !strings.HasPrefix(body, "<nav><li><a ") || !strings.HasSuffix(body, "</a></li></nav>") {
+		t.Errorf("expected the custom template, got %q", body)
+	}
+
+	for _, cfg := range []*traefik_lang_redirect.Config{picker(traefik_lang_redirect.StrategyHeader), picker(traefik_lang_redirect.StrategyPath)} {
+		if cfg.LanguageStrategy == traefik_lang_redirect.StrategyPath {
+			cfg.PickerTemplate = "<ul></ul>"
+		}
+		if _, err := traefik_lang_redirect.New(context.Background(), http.NewServeMux(), cfg, "lang-redirect"); err == nil {
+			t.Errorf("expected an error for the %s strategy with template %q", cfg.LanguageStrategy, cfg.PickerTemplate)
+		}
+	}
+}